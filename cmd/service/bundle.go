@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/patrickfnielsen/gear/internal/config"
+	"github.com/patrickfnielsen/gear/internal/deploy"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+	"github.com/patrickfnielsen/gear/internal/state"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"golang.org/x/exp/slog"
+)
+
+// diffContext is the number of unchanged lines shown around a change
+const diffContext = 3
+
+// diffCommand shows the files that would change if the newest commit was deployed.
+// The exit code is exitChanges if any file would change
+func diffCommand(c *cli, args []string) int {
+	commit := c.flags.String("commit", "", "compare with this commit, instead of the newest commit")
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	cfg, log, err := c.load(false)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	repositories, err := c.repositories(log, cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	code := exitOK
+	for _, repo := range repositories {
+		bundle, err := c.generateBundle(log, cfg, repo, *commit)
+		if err != nil {
+			printError(err)
+			return exitError
+		}
+
+		changes, err := repo.runtime.DiffBundle(bundle)
+		if err != nil {
+			printError(err)
+			return exitError
+		}
+
+		fmt.Printf("repository %s: %s -> %s\n", repo.name(), orNone(repo.state.CurrentHash), bundle.Hash)
+		if len(changes) == 0 {
+			fmt.Println("no changes")
+			continue
+		}
+
+		code = exitChanges
+		for _, change := range changes {
+			printFileChange(change)
+		}
+	}
+
+	return code
+}
+
+// renderCommand renders the bundle of the newest commit for this host, and either prints it or
+// writes it to a directory. Secrets are only shown when asked for
+func renderCommand(c *cli, args []string) int {
+	commit := c.flags.String("commit", "", "render this commit, instead of the newest commit")
+	output := c.flags.String("output", "", "write the bundle to this directory, instead of printing it")
+	showSecrets := c.flags.Bool("show-secrets", false, "print the content of decrypted secrets")
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	cfg, log, err := c.load(false)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	repositories, err := c.repositories(log, cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	for _, repo := range repositories {
+		bundle, err := c.generateBundle(log, cfg, repo, *commit)
+		if err != nil {
+			printError(err)
+			return exitError
+		}
+
+		if *output != "" {
+			directory := path.Join(*output, repo.repoConfig.Name)
+			if err := writeBundle(directory, bundle); err != nil {
+				printError(err)
+				return exitError
+			}
+
+			fmt.Fprintf(os.Stderr, "rendered %s at %s to %s\n", repo.name(), bundle.Hash, directory)
+			continue
+		}
+
+		fmt.Printf("# repository %s: %s\n", repo.name(), bundle.Hash)
+		for _, file := range bundle.Files {
+			fmt.Printf("--- %s\n", file.FileName)
+			if file.IsSecret && !*showSecrets {
+				fmt.Printf("(secret, %d bytes)\n", len(file.Data))
+				continue
+			}
+
+			fmt.Print(string(file.Data))
+			if len(file.Data) > 0 && !strings.HasSuffix(string(file.Data), "\n") {
+				fmt.Println()
+			}
+		}
+	}
+
+	return exitOK
+}
+
+// validateCommand validates the config, and loads every project in the bundle of the newest commit,
+// without deploying anything. The exit code is exitError if the config or any bundle is invalid
+func validateCommand(c *cli, args []string) int {
+	commit := c.flags.String("commit", "", "validate this commit, instead of the newest commit")
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	cfg, log, err := c.load(false)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	repositories, err := c.repositories(log, cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	code := exitOK
+	for _, repo := range repositories {
+		hash, projects, err := c.validateRepository(log, cfg, repo, *commit)
+		if err != nil {
+			fmt.Printf("repository %s: invalid\n", repo.name())
+			printError(err)
+			code = exitError
+			continue
+		}
+
+		fmt.Printf("repository %s: %s is valid\n", repo.name(), hash)
+		for _, project := range projects {
+			fmt.Printf("  project %s\n", project)
+		}
+	}
+
+	return code
+}
+
+// validateRepository generates the bundle and loads its projects in a temporary directory, as it
+// contains the decrypted secrets it's kept in memory if possible
+func (c *cli) validateRepository(log *slog.Logger, cfg *config.Config, repo *repository, commit string) (string, []string, error) {
+	bundle, err := c.generateBundle(log, cfg, repo, commit)
+	if err != nil {
+		return "", nil, err
+	}
+
+	directory, err := os.MkdirTemp(memoryTempDirectory(), "gear-validate-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(directory)
+
+	runtime := deploy.NewRuntimeActivator(repo.repoConfig.Name, path.Join(directory, "deployments"), path.Join(directory, "secrets"), "", 0, &state.DeploymentState{})
+	projects, err := runtime.LoadBundle(bundle)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var names []string
+	for _, project := range projects {
+		names = append(names, project.Name)
+	}
+
+	return bundle.Hash, names, nil
+}
+
+// generateBundle creates the bundle of the newest commit of the repository, or of the given commit
+func (c *cli) generateBundle(log *slog.Logger, cfg *config.Config, repo *repository, commit string) (*gitops.Bundle, error) {
+	gops := repo.gitops
+	if commit != "" {
+		var err error
+		gops, err = c.pinnedRepository(log, cfg, repo, commit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bundle, err := gops.GenerateBundle()
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to create bundle for repository '%s'", repo.name()))
+	}
+
+	return bundle, nil
+}
+
+// writeBundle writes the files of the bundle to a directory, secrets are only readable by the current user
+func writeBundle(directory string, bundle *gitops.Bundle) error {
+	for _, file := range bundle.Files {
+		fileName := filepath.Join(directory, path.Clean("/"+file.FileName))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			return err
+		}
+
+		mode := file.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		if file.IsSecret {
+			mode = 0600
+		}
+
+		if err := os.WriteFile(fileName, file.Data, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printFileChange prints a changed file, with a line diff for files that are not secrets
+func printFileChange(change deploy.FileChange) {
+	switch change.Status {
+	case deploy.ChangeAdded:
+		fmt.Printf("added:    %s\n", change.FileName)
+	case deploy.ChangeRemoved:
+		fmt.Printf("removed:  %s\n", change.FileName)
+	case deploy.ChangeUnknown:
+		fmt.Printf("unknown:  %s (deployed secret is not available)\n", change.FileName)
+	case deploy.ChangeModified:
+		fmt.Printf("modified: %s\n", change.FileName)
+		if change.IsSecret {
+			fmt.Println("  (secret, content not shown)")
+			return
+		}
+
+		printLineDiff(string(change.Old), string(change.New))
+	}
+}
+
+// printLineDiff prints the changed lines, with a few unchanged lines around each change
+func printLineDiff(old string, new string) {
+	diffs := diff.Do(old, new)
+	for i, d := range diffs {
+		lines := strings.SplitAfter(d.Text, "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+
+		switch d.Type {
+		case diffmatchpatch.DiffDelete:
+			printLines("  -", lines)
+		case diffmatchpatch.DiffInsert:
+			printLines("  +", lines)
+		case diffmatchpatch.DiffEqual:
+			// only show the lines next to a change
+			head, tail := lines, []string(nil)
+			if i == 0 {
+				head = nil
+			}
+			if i < len(diffs)-1 {
+				tail = lines
+			}
+
+			if len(head) > diffContext {
+				head = head[:diffContext]
+			}
+			if len(tail) > diffContext {
+				tail = tail[len(tail)-diffContext:]
+			}
+
+			if len(head)+len(tail) >= len(lines) {
+				printLines("   ", lines)
+				continue
+			}
+
+			printLines("   ", head)
+			fmt.Println("  ...")
+			printLines("   ", tail)
+		}
+	}
+}
+
+func printLines(prefix string, lines []string) {
+	for _, line := range lines {
+		fmt.Println(prefix + strings.TrimSuffix(line, "\n"))
+	}
+}
+
+func orNone(hash string) string {
+	if hash == "" {
+		return "(nothing deployed)"
+	}
+
+	return hash
+}
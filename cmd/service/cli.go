@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"filippo.io/age"
+	"github.com/patrickfnielsen/gear/internal/config"
+	"github.com/patrickfnielsen/gear/internal/deploy"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+	"github.com/patrickfnielsen/gear/internal/logger"
+	"github.com/patrickfnielsen/gear/internal/secrets"
+	"github.com/patrickfnielsen/gear/internal/state"
+	"golang.org/x/exp/slog"
+)
+
+// exit codes, so gear can be used from scripts
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+	// exitChanges is used when there are changes that are not deployed, or the last deployment failed
+	exitChanges = 3
+)
+
+const usage = `usage: gear <command> [flags]
+
+commands:
+  run                  sync and deploy all repositories, until stopped (default)
+  sync                 sync and deploy all repositories, use --once to sync a single time
+  status               show the deployed commit of each repository
+  history              show the deployments of each repository
+  diff                 show the files that would change, if the newest commit was deployed
+  plan                 show the projects and services that would change, if the newest commit was deployed
+  render               render the bundle of the newest commit, without deploying it
+  validate             validate the config, and the bundle of the newest commit
+  rollback <hash>      deploy an older commit
+  secrets              encrypt and decrypt secrets, see gear secrets
+
+shared flags:
+  --config <file>      config file (default config.yaml)
+  --state-file <file>  deployment state file, when a single repository is used
+  --repository <name>  only use the named repository
+  --verbose            show debug logs
+
+exit codes:
+  0  success
+  1  error
+  2  invalid usage
+  3  changes not deployed (diff and plan), or the last deployment failed (status)
+`
+
+type command func(cli *cli, args []string) int
+
+var commands = map[string]command{
+	"run":      runCommand,
+	"sync":     syncCommand,
+	"status":   statusCommand,
+	"history":  historyCommand,
+	"diff":     diffCommand,
+	"plan":     planCommand,
+	"render":   renderCommand,
+	"validate": validateCommand,
+	"rollback": rollbackCommand,
+}
+
+// cli holds the flags shared by all commands, and the keys loaded for the repositories
+type cli struct {
+	flags      *flag.FlagSet
+	configFile string
+	stateFile  string
+	repository string
+	verbose    bool
+
+	identities      []age.Identity
+	secretProviders map[string]secrets.Provider
+}
+
+// target is a repository a command works on, with the state file it uses
+type target struct {
+	repoConfig config.RepoConfig
+	stateFile  string
+}
+
+func runCLI(args []string) int {
+	name := "run"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "secrets" {
+		return runSecretsCommand(args)
+	}
+
+	if name == "help" {
+		fmt.Fprint(os.Stdout, usage)
+		return exitOK
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", name)
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+
+	return cmd(newCLI(name), args)
+}
+
+func newCLI(name string) *cli {
+	c := &cli{flags: flag.NewFlagSet(name, flag.ContinueOnError)}
+	c.flags.StringVar(&c.configFile, "config", config.DefaultFileName, "config file")
+	c.flags.StringVar(&c.stateFile, "state-file", "", "deployment state file, when a single repository is used")
+	c.flags.StringVar(&c.repository, "repository", "", "only use the named repository")
+	c.flags.BoolVar(&c.verbose, "verbose", false, "show debug logs")
+	return c
+}
+
+// parse parses the flags of the command, and returns false if the arguments are invalid
+func (c *cli) parse(args []string) bool {
+	return c.flags.Parse(args) == nil
+}
+
+// load reads the config, and sets up the logger. Commands other than run and sync log to
+// stderr, and only warnings unless verbose is set, so the output of the command can be used
+func (c *cli) load(daemon bool) (*config.Config, *slog.Logger, error) {
+	cfg, err := config.LoadConfig(c.configFile)
+	if err != nil {
+		return nil, slog.Default(), errors.Join(err, fmt.Errorf("failed to load config '%s'", c.configFile))
+	}
+
+	level := slog.LevelWarn
+	output := os.Stderr
+	if daemon {
+		level, output = slog.LevelDebug, os.Stdout
+	}
+	if c.verbose {
+		level = slog.LevelDebug
+	}
+
+	return cfg, logger.SetupLogger(output, level, cfg.Environment), nil
+}
+
+// targets returns the repositories the command works on
+func (c *cli) targets(cfg *config.Config) ([]target, error) {
+	var targets []target
+	for _, repoConfig := range cfg.Repositories {
+		if c.repository != "" && repoConfig.Name != c.repository {
+			continue
+		}
+
+		stateFile := state.FileName(repoConfig.Name)
+		if c.stateFile != "" {
+			stateFile = c.stateFile
+		}
+
+		targets = append(targets, target{repoConfig: repoConfig, stateFile: stateFile})
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no repository named '%s' in the config", c.repository)
+	}
+
+	if c.stateFile != "" && len(targets) > 1 {
+		return nil, errors.New("--state-file can only be used with a single repository, use --repository to select one")
+	}
+
+	return targets, nil
+}
+
+// repository is a target opened by a command, with its deployed state
+type repository struct {
+	target
+	state   *state.DeploymentState
+	gitops  *gitops.GitOps
+	runtime *deploy.RuntimeActivator
+}
+
+// repositories opens the git sync and runtime of each target
+func (c *cli) repositories(log *slog.Logger, cfg *config.Config) ([]*repository, error) {
+	targets, err := c.targets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c.identities, err = loadEncryptionKey(log, cfg.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c.secretProviders, err = loadSecretProviders(log, cfg.SecretProviders)
+	if err != nil {
+		return nil, err
+	}
+
+	healthTimeout := time.Second * time.Duration(cfg.Deployment.HealthTimeout)
+	var repositories []*repository
+	for _, t := range targets {
+		log.Info("loading deployment state", slog.String("repository", t.repoConfig.Name), slog.String("file", t.stateFile))
+		deploymentState := state.LoadDeploymentState(t.stateFile)
+
+		runtime := deploy.NewRuntimeActivator(t.repoConfig.Name, cfg.Deployment.Directory, cfg.Deployment.SecretsDirectory, t.stateFile, healthTimeout, deploymentState)
+		gops, err := loadRepository(log, t.repoConfig, cfg.Labels, cfg.LabelOrder, cfg.Variables, newSyncState(deploymentState, !runtime.HasSecrets()), c.identities, c.secretProviders)
+		if err != nil {
+			return nil, errors.Join(err, fmt.Errorf("failed to load repository '%s'", t.repoConfig.Url))
+		}
+
+		repositories = append(repositories, &repository{target: t, state: deploymentState, gitops: gops, runtime: runtime})
+	}
+
+	return repositories, nil
+}
+
+// pinnedRepository returns the git sync of an opened repository, pinned to a commit
+func (c *cli) pinnedRepository(log *slog.Logger, cfg *config.Config, repo *repository, hash string) (*gitops.GitOps, error) {
+	repoConfig := repo.repoConfig
+	repoConfig.Commit = hash
+	repoConfig.Tag = ""
+	return loadRepository(log, repoConfig, cfg.Labels, cfg.LabelOrder, cfg.Variables, newSyncState(repo.state, false), c.identities, c.secretProviders)
+}
+
+// lock takes the lock of the deployment state, so no other gear process deploys the repository until it's released.
+// If another process changed the deployment state, like a rollback while gear is running, it's reloaded
+func (r *repository) lock() (func(), error) {
+	unlock, err := state.Lock(r.stateFile)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to lock the deployment state of repository '%s'", r.name()))
+	}
+
+	if deploymentState, changed := r.runtime.ReloadState(); changed {
+		r.state = deploymentState
+		r.gitops.SetState(newSyncState(deploymentState, !r.runtime.HasSecrets()))
+	}
+
+	return unlock, nil
+}
+
+// loadEncryptionKey reads the identities used to decrypt secrets, if a key file is configured
+func loadEncryptionKey(log *slog.Logger, keyFile string) ([]age.Identity, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	log.Info("loading encryption key", slog.String("file", keyFile))
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read encryption key"))
+	}
+
+	identities, err := gitops.ParseIdentities(data)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to parse encryption key"))
+	}
+
+	return identities, nil
+}
+
+// name returns the name of the repository for output, the url is used for an unnamed repository
+func (t target) name() string {
+	if t.repoConfig.Name != "" {
+		return t.repoConfig.Name
+	}
+
+	return t.repoConfig.Url
+}
+
+func printError(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/patrickfnielsen/gear/internal/config"
+	"github.com/patrickfnielsen/gear/internal/deploy"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+	"golang.org/x/exp/slog"
+)
+
+// repositoryPlan is the plan of a single repository, the plan is only made if the sync would deploy a commit
+type repositoryPlan struct {
+	Repository string `json:"repository"`
+	UpToDate   bool   `json:"up_to_date"`
+	Skipped    string `json:"skipped,omitempty"`
+	*deploy.Plan
+}
+
+// planCommand shows what would change if the newest commit was deployed, without changing anything.
+// The exit code is exitChanges if any project would be created, recreated or removed
+func planCommand(c *cli, args []string) int {
+	commit := c.flags.String("commit", "", "plan this commit, instead of the newest commit")
+	jsonOutput := c.flags.Bool("json", false, "print the plan as json")
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	cfg, log, err := c.load(false)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	repositories, err := c.repositories(log, cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	code := exitOK
+	var plans []repositoryPlan
+	for _, repo := range repositories {
+		plan, err := c.planRepository(log, cfg, repo, *commit)
+		if err != nil {
+			printError(err)
+			return exitError
+		}
+
+		if plan.Plan != nil && plan.HasChanges() {
+			code = exitChanges
+		}
+
+		plans = append(plans, plan)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plans); err != nil {
+			printError(err)
+			return exitError
+		}
+
+		return code
+	}
+
+	for _, plan := range plans {
+		printPlan(plan)
+	}
+
+	return code
+}
+
+// planRepository checks for an update the same way as a sync, and plans the deployment of it
+func (c *cli) planRepository(log *slog.Logger, cfg *config.Config, repo *repository, commit string) (repositoryPlan, error) {
+	plan := repositoryPlan{Repository: repo.name()}
+	if commit == "" {
+		update, err := repo.gitops.CheckForUpdates()
+		if err != nil {
+			return plan, errors.Join(err, fmt.Errorf("failed to check for updates of repository '%s'", repo.name()))
+		}
+
+		// the current commit is deployed again if its secrets are missing, like after a reboot
+		if !update.Available && repo.runtime.HasSecrets() {
+			plan.UpToDate = true
+			return plan, nil
+		}
+
+		if update.NewHash == repo.state.FailedHash {
+			plan.Skipped = fmt.Sprintf("commit %s failed to deploy, it's not deployed again until a newer commit is pushed", update.NewHash)
+			return plan, nil
+		}
+
+		if update.NewHash == repo.state.RolledBackHash {
+			plan.Skipped = fmt.Sprintf("commit %s was rolled back, it's not deployed again until a newer commit is pushed", update.NewHash)
+			return plan, nil
+		}
+	}
+
+	bundle, err := c.generateBundle(log, cfg, repo, commit)
+	if errors.Is(err, gitops.ErrDowngrade) {
+		plan.Skipped = err.Error()
+		return plan, nil
+	}
+
+	if err != nil {
+		return plan, err
+	}
+
+	// the bundle contains the decrypted secrets, so it's kept in memory if possible
+	directory, err := os.MkdirTemp(memoryTempDirectory(), "gear-plan-")
+	if err != nil {
+		return plan, err
+	}
+	defer os.RemoveAll(directory)
+
+	plan.Plan, err = repo.runtime.Plan(context.Background(), bundle, directory)
+	if err != nil {
+		return plan, errors.Join(err, fmt.Errorf("failed to plan repository '%s'", repo.name()))
+	}
+
+	return plan, nil
+}
+
+func printPlan(plan repositoryPlan) {
+	switch {
+	case plan.UpToDate:
+		fmt.Printf("repository %s: up to date\n", plan.Repository)
+		return
+	case plan.Skipped != "":
+		fmt.Printf("repository %s: skipped, %s\n", plan.Repository, plan.Skipped)
+		return
+	}
+
+	fmt.Printf("repository %s: %s -> %s\n", plan.Repository, orNone(plan.CurrentHash), plan.NewHash)
+	for _, project := range plan.Projects {
+		fmt.Printf("  %-10s project %s\n", project.Action, project.Name)
+		for _, service := range project.Services {
+			fmt.Printf("    %-10s service %s\n", service.Action, service.Name)
+			for _, change := range service.Changes {
+				fmt.Printf("      %s: %s\n", change.Field, formatServiceChange(change))
+			}
+		}
+	}
+}
+
+func formatServiceChange(change deploy.ServiceChange) string {
+	if change.Field == "image" {
+		return fmt.Sprintf("%s -> %s", strings.Join(change.Removed, ""), strings.Join(change.Added, ""))
+	}
+
+	var parts []string
+	if len(change.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(change.Added, ", "))
+	}
+	if len(change.Changed) > 0 {
+		parts = append(parts, "changed "+strings.Join(change.Changed, ", "))
+	}
+	if len(change.Removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(change.Removed, ", "))
+	}
+
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/patrickfnielsen/gear/internal/config"
+	"github.com/patrickfnielsen/gear/internal/secrets"
+	"golang.org/x/exp/slog"
+)
+
+// loadSecretProviders creates the configured external secret providers, by name
+func loadSecretProviders(log *slog.Logger, providerConfigs []config.SecretProviderConfig) (map[string]secrets.Provider, error) {
+	providers := make(map[string]secrets.Provider)
+	for _, providerConfig := range providerConfigs {
+		log.Info("loading secret provider", slog.String("name", providerConfig.Name), slog.String("type", providerConfig.Type))
+
+		switch providerConfig.Type {
+		case "exec":
+			providers[providerConfig.Name] = secrets.NewExecProvider(providerConfig.Command)
+		case "vault":
+			var token []byte
+			if providerConfig.TokenFile != "" {
+				data, err := os.ReadFile(providerConfig.TokenFile)
+				if err != nil {
+					return nil, errors.Join(err, errors.New("failed to read vault token"))
+				}
+				token = bytes.TrimSpace(data)
+			} else {
+				token = []byte(os.Getenv(providerConfig.TokenEnv))
+				if len(token) == 0 {
+					return nil, errors.New("vault token environment variable is empty")
+				}
+			}
+
+			providers[providerConfig.Name] = secrets.NewVaultProvider(providerConfig.Address, string(token), providerConfig.Mount, providerConfig.KVVersion)
+		}
+	}
+
+	return providers, nil
+}
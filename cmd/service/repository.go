@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/patrickfnielsen/gear/internal/config"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+	"github.com/patrickfnielsen/gear/internal/secrets"
+	"github.com/patrickfnielsen/gear/internal/state"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+)
+
+// newSyncState returns the state to sync a repository from, the current commit is deployed again if forceDeploy is set
+func newSyncState(deploymentState *state.DeploymentState, forceDeploy bool) gitops.SyncState {
+	return gitops.SyncState{
+		CurrentHash:    deploymentState.CurrentHash,
+		CurrentRef:     deploymentState.CurrentRef,
+		CurrentTree:    deploymentState.CurrentTree,
+		FailedHash:     deploymentState.FailedHash,
+		RolledBackHash: deploymentState.RolledBackHash,
+		ForceDeploy:    forceDeploy,
+	}
+}
+
+// loadRepository reads the keys and tokens of a repository, and creates the git sync for it
+func loadRepository(log *slog.Logger, repoConfig config.RepoConfig, labels map[string]string, labelOrder []string, variables map[string]string, syncState gitops.SyncState, identities []age.Identity, secretProviders map[string]secrets.Provider) (*gitops.GitOps, error) {
+	var err error
+	var sshKey []byte
+	if repoConfig.SSHKeyFile != "" {
+		log.Info("loading ssh key", slog.String("file", repoConfig.SSHKeyFile))
+		sshKey, err = os.ReadFile(repoConfig.SSHKeyFile)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to read ssh key"))
+		}
+	}
+
+	var token []byte
+	if repoConfig.TokenFile != "" {
+		log.Info("loading repository token", slog.String("file", repoConfig.TokenFile))
+		token, err = os.ReadFile(repoConfig.TokenFile)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to read repository token"))
+		}
+		token = bytes.TrimSpace(token)
+	}
+
+	if repoConfig.TokenEnv != "" {
+		log.Info("loading repository token", slog.String("env", repoConfig.TokenEnv))
+		token = []byte(os.Getenv(repoConfig.TokenEnv))
+		if len(token) == 0 {
+			return nil, errors.New("repository token environment variable is empty")
+		}
+	}
+
+	var trustedGPGKeys []byte
+	if repoConfig.TrustedGPGKeysFile != "" {
+		log.Info("loading trusted gpg keys", slog.String("file", repoConfig.TrustedGPGKeysFile))
+		trustedGPGKeys, err = os.ReadFile(repoConfig.TrustedGPGKeysFile)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to read trusted gpg keys"))
+		}
+	}
+
+	var trustedSSHKeys []gossh.PublicKey
+	if repoConfig.TrustedSSHKeysFile != "" {
+		log.Info("loading trusted ssh keys", slog.String("file", repoConfig.TrustedSSHKeysFile))
+		data, err := os.ReadFile(repoConfig.TrustedSSHKeysFile)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to read trusted ssh keys"))
+		}
+
+		trustedSSHKeys, err = gitops.ParseSSHSigningKeys(data)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to parse trusted ssh keys"))
+		}
+	}
+
+	return gitops.NewGitSync(
+		gitops.Host{
+			Identifier: repoConfig.OverrideIdentifier,
+			Labels:     labels,
+			LabelOrder: labelOrder,
+			Variables:  variables,
+		},
+		syncState,
+		identities,
+		secretProviders,
+		gitops.Repository{
+			Url:            repoConfig.Url,
+			Branch:         repoConfig.Branch,
+			Tag:            repoConfig.Tag,
+			Commit:         repoConfig.Commit,
+			AllowDowngrade: repoConfig.AllowDowngrade,
+			Path:           strings.Trim(repoConfig.Path, "/"),
+			CacheDirectory: repoConfig.CacheDirectory,
+			Include:        repoConfig.Include,
+			Exclude:        repoConfig.Exclude,
+
+			SSHKey:   sshKey,
+			Username: repoConfig.Username,
+			Token:    token,
+
+			KnownHostsFile:      repoConfig.KnownHostsFile,
+			HostKeyFingerprints: repoConfig.HostKeyFingerprints,
+			TrustOnFirstUse:     repoConfig.TrustOnFirstUse,
+
+			TrustedGPGKeys: string(trustedGPGKeys),
+			TrustedSSHKeys: trustedSSHKeys,
+		},
+	), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/patrickfnielsen/gear/internal/state"
+	"golang.org/x/exp/slog"
+)
+
+// rollbackCommand deploys an older commit of a repository. The newest commit is recorded as rolled back,
+// so it's not deployed again by the next sync, only a newer commit is deployed. The deployment state is
+// locked during the rollback, so a running gear waits for it, and reloads the state when it's done
+func rollbackCommand(c *cli, args []string) int {
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	hash := c.flags.Arg(0)
+	if c.flags.NArg() != 1 || !plumbing.IsHash(hash) {
+		fmt.Fprintln(os.Stderr, "usage: gear rollback [flags] <full commit hash>")
+		return exitUsage
+	}
+
+	cfg, log, err := c.load(true)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	repositories, err := c.repositories(log, cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	if len(repositories) != 1 {
+		printError(errors.New("rollback can only be used with a single repository, use --repository to select one"))
+		return exitUsage
+	}
+
+	repo := repositories[0]
+	unlock, err := repo.lock()
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+	defer unlock()
+
+	bundle, err := c.generateBundle(log, cfg, repo, hash)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	log.Info("rolling back", slog.String("repository", repo.name()), slog.String("current_hash", repo.state.CurrentHash), slog.String("commit_hash", bundle.Hash))
+	if err := repo.runtime.DeployUpdate(context.Background(), bundle); err != nil {
+		printError(errors.Join(err, errors.New("rollback failed")))
+		return exitError
+	}
+
+	// keep the rolled back commit from being deployed again
+	update, err := repo.gitops.CheckForUpdates()
+	if err != nil {
+		printError(errors.Join(err, errors.New("rolled back, but failed to get the newest commit, it might be deployed again on the next sync")))
+		return exitError
+	}
+
+	if update.NewHash != bundle.Hash {
+		_, err = state.SaveRollback(repo.stateFile, state.LoadDeploymentState(repo.stateFile), update.NewHash, update.NewRef)
+		if err != nil {
+			printError(errors.Join(err, errors.New("unable to update deployment state")))
+			return exitError
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "rolled back %s to %s\n", repo.name(), bundle.Hash)
+	return exitOK
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/patrickfnielsen/gear/internal/gitops"
+	"github.com/patrickfnielsen/gear/internal/utils"
+	"github.com/patrickfnielsen/gear/internal/webhook"
+	"golang.org/x/exp/slog"
+)
+
+// runCommand syncs and deploys all repositories until gear is stopped, this is the default command
+func runCommand(c *cli, args []string) int {
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	return c.daemon(true)
+}
+
+// syncCommand syncs and deploys all repositories, either a single time or until gear is stopped
+func syncCommand(c *cli, args []string) int {
+	once := c.flags.Bool("once", false, "sync a single time, and exit")
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	if !*once {
+		return c.daemon(false)
+	}
+
+	cfg, log, err := c.load(true)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	repositories, err := c.repositories(log, cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	// the secrets are kept after the sync, as the deployed runtimes still use them
+	ctx := context.Background()
+	code := exitOK
+	for _, repo := range repositories {
+		unlock, err := repo.lock()
+		if err != nil {
+			printError(err)
+			return exitError
+		}
+
+		err = repo.gitops.SyncOnce(func(b *gitops.Bundle) error {
+			log.Info("new version available", slog.String("repository", repo.repoConfig.Name), slog.String("commit_hash", b.Hash))
+			return repo.runtime.DeployUpdate(ctx, b)
+		})
+		unlock()
+		if err != nil {
+			log.Error("failed to sync repository", slog.String("repository", repo.name()), slog.String("error", err.Error()))
+			code = exitError
+		}
+	}
+
+	return code
+}
+
+// daemon syncs the repositories on their interval, and on webhooks if enabled, until gear is stopped
+func (c *cli) daemon(enableWebhook bool) int {
+	cfg, log, err := c.load(true)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	log.Info("G.E.A.R (Git-Enabled Automation and Release) starting...", slog.String("environment", cfg.Environment))
+
+	repositories, err := c.repositories(log, cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	var webhookSecret []byte
+	if enableWebhook && cfg.Webhook.Listen != "" {
+		log.Info("loading webhook secret", slog.String("file", cfg.Webhook.SecretFile))
+		webhookSecret, err = os.ReadFile(cfg.Webhook.SecretFile)
+		if err != nil {
+			printError(errors.Join(err, errors.New("failed to read webhook secret")))
+			return exitError
+		}
+	}
+
+	// each repository is synced and deployed on its own, with its own state
+	ctx, cancel := context.WithCancel(context.Background())
+	var syncs sync.WaitGroup
+	for _, repo := range repositories {
+		repo.gitops.StartSync(ctx, &syncs, repo.repoConfig.SyncInterval, repo.lock, func(b *gitops.Bundle) error {
+			log.Info("new version available", slog.String("repository", repo.repoConfig.Name), slog.String("commit_hash", b.Hash))
+			return repo.runtime.DeployUpdate(ctx, b)
+		})
+	}
+
+	if webhookSecret != nil {
+		server := webhook.NewServer(cfg.Webhook.Listen, cfg.Webhook.Path, bytes.TrimSpace(webhookSecret), func(event webhook.PushEvent) {
+			// only the repositories the push can change are synced
+			for _, repo := range repositories {
+				if repo.gitops.MatchesPush(event.Repositories, event.Ref) {
+					log.Info("triggering sync", slog.String("repository", repo.repoConfig.Name), slog.String("ref", event.Ref))
+					repo.gitops.TriggerSync()
+				}
+			}
+		})
+		server.Start(ctx)
+	}
+
+	// a second signal while shutting down is ignored, the deployments in progress are still awaited
+	quit := make(chan struct{})
+	var stop sync.Once
+	go utils.MonitorSystemSignals(func(s os.Signal) {
+		stop.Do(func() {
+			log.Info("shutting down", slog.String("signal", s.String()))
+			cancel()
+			close(quit)
+		})
+	})
+
+	// wait for shutdown, and for the deployments in progress to stop
+	<-quit
+	syncs.Wait()
+
+	// secrets only live in memory while gear is running
+	for _, repo := range repositories {
+		if err := repo.runtime.RemoveSecrets(); err != nil {
+			log.Error("failed to remove secrets", slog.String("error", err.Error()))
+		}
+	}
+
+	return exitOK
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/patrickfnielsen/gear/internal/config"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+)
+
+// recipientsFileName lists the recipients secrets in the repository are encrypted to
+const recipientsFileName = ".gear-recipients"
+
+const secretsUsage = `usage: gear secrets <command> [flags] [file]
+
+commands:
+  encrypt <file>       encrypt a file to the recipients, writing <file>.enc
+  decrypt <file.enc>   decrypt a file, writing it to stdout
+  edit <file.enc>      decrypt a file, open it in $EDITOR, and encrypt it again
+  rekey [directory]    encrypt all .enc files in the directory again, to the current recipients
+`
+
+// runSecretsCommand runs the secrets sub commands, and returns the exit code
+func runSecretsCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, secretsUsage)
+		return exitUsage
+	}
+
+	flags := flag.NewFlagSet("secrets "+args[0], flag.ContinueOnError)
+	configFile := flags.String("config", config.DefaultFileName, "config file, used for the default identity file")
+	identityFile := flags.String("identity", "", "identity file used to decrypt, defaults to encryption_key_file in the config")
+	recipientsFile := flags.String("recipients", "", "recipients file, defaults to "+recipientsFileName+" in the current directory or a parent directory")
+	output := flags.String("output", "", "file to write to, instead of the default")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	var err error
+	switch args[0] {
+	case "encrypt":
+		err = encryptCommand(flags.Arg(0), *recipientsFile, *output)
+	case "decrypt":
+		err = decryptCommand(flags.Arg(0), *configFile, *identityFile, *output)
+	case "edit":
+		err = editCommand(flags.Arg(0), *configFile, *identityFile, *recipientsFile)
+	case "rekey":
+		directory := flags.Arg(0)
+		if directory == "" {
+			directory = "."
+		}
+		err = rekeyCommand(directory, *configFile, *identityFile, *recipientsFile)
+	default:
+		fmt.Fprint(os.Stderr, secretsUsage)
+		return exitUsage
+	}
+
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	return exitOK
+}
+
+func encryptCommand(fileName string, recipientsFile string, output string) error {
+	if fileName == "" {
+		return errors.New("missing file to encrypt")
+	}
+
+	recipients, err := loadRecipients(recipientsFile, filepath.Dir(fileName))
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := gitops.EncryptSecret(recipients, data)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		output = fileName + ".enc"
+	}
+
+	if err := os.WriteFile(output, encrypted, 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "encrypted %s to %s, remember to not commit the unencrypted file\n", fileName, output)
+	return nil
+}
+
+func decryptCommand(fileName string, configFile string, identityFile string, output string) error {
+	if fileName == "" {
+		return errors.New("missing file to decrypt")
+	}
+
+	identities, err := loadIdentities(configFile, identityFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	decrypted, err := gitops.DecryptSecret(identities, fileName, data)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		_, err = os.Stdout.Write(decrypted)
+		return err
+	}
+
+	return os.WriteFile(output, decrypted, 0600)
+}
+
+func editCommand(fileName string, configFile string, identityFile string, recipientsFile string) error {
+	if fileName == "" {
+		return errors.New("missing file to edit")
+	}
+
+	identities, err := loadIdentities(configFile, identityFile)
+	if err != nil {
+		return err
+	}
+
+	recipients, err := loadRecipients(recipientsFile, filepath.Dir(fileName))
+	if err != nil {
+		return err
+	}
+
+	// a new file is created if it doesn't exist
+	var decrypted []byte
+	data, err := os.ReadFile(fileName)
+	if err == nil {
+		decrypted, err = gitops.DecryptSecret(identities, fileName, data)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// keep the decrypted file in memory if possible, and only readable by the current user
+	tempFile, err := os.CreateTemp(memoryTempDirectory(), "gear-edit-*-"+filepath.Base(strings.TrimSuffix(fileName, ".enc")))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(decrypted); err != nil {
+		tempFile.Close()
+		return err
+	}
+	tempFile.Close()
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", tempFile.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Join(err, errors.New("editor failed, file not changed"))
+	}
+
+	edited, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := gitops.EncryptSecret(recipients, edited)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, encrypted, 0644)
+}
+
+func rekeyCommand(directory string, configFile string, identityFile string, recipientsFile string) error {
+	identities, err := loadIdentities(configFile, identityFile)
+	if err != nil {
+		return err
+	}
+
+	recipients, err := loadRecipients(recipientsFile, directory)
+	if err != nil {
+		return err
+	}
+
+	// all files are decrypted before any are written, so a file that can't be decrypted leaves everything untouched
+	rekeyed := make(map[string][]byte)
+	err = filepath.WalkDir(directory, func(fileName string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		if d.IsDir() || filepath.Ext(fileName) != ".enc" {
+			return nil
+		}
+
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+
+		decrypted, err := gitops.DecryptSecret(identities, fileName, data)
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := gitops.EncryptSecret(recipients, decrypted)
+		if err != nil {
+			return err
+		}
+
+		rekeyed[fileName] = encrypted
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for fileName, encrypted := range rekeyed {
+		if err := os.WriteFile(fileName, encrypted, 0644); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "rekeyed %s\n", fileName)
+	}
+
+	fmt.Fprintf(os.Stderr, "rekeyed %d files to %d recipients\n", len(rekeyed), len(recipients))
+	return nil
+}
+
+// memoryTempDirectory returns a RAM backed directory for temporary files holding secrets, if
+// there is none the default temporary directory is used
+func memoryTempDirectory() string {
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		return "/dev/shm"
+	}
+
+	return ""
+}
+
+// loadRecipients reads the recipients file, if no file is given the .gear-recipients
+// file is searched for in the directory and its parents
+func loadRecipients(recipientsFile string, directory string) ([]age.Recipient, error) {
+	if recipientsFile == "" {
+		directory, err := filepath.Abs(directory)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			candidate := filepath.Join(directory, recipientsFileName)
+			if _, err := os.Stat(candidate); err == nil {
+				recipientsFile = candidate
+				break
+			}
+
+			parent := filepath.Dir(directory)
+			if parent == directory {
+				return nil, fmt.Errorf("no %s file found", recipientsFileName)
+			}
+			directory = parent
+		}
+	}
+
+	data, err := os.ReadFile(recipientsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients, err := gitops.ParseRecipients(data)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("invalid recipients file '%s'", recipientsFile))
+	}
+
+	return recipients, nil
+}
+
+// loadIdentities reads the identity file, if no file is given the encryption key from the config is used
+func loadIdentities(configFile string, identityFile string) ([]age.Identity, error) {
+	if identityFile == "" {
+		config, err := config.LoadConfig(configFile)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("no identity file given, and no config found"))
+		}
+
+		if config.EncryptionKeyFile == "" {
+			return nil, errors.New("no identity file given, and encryption_key_file is not set in the config")
+		}
+
+		identityFile = config.EncryptionKeyFile
+	}
+
+	data, err := os.ReadFile(identityFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return gitops.ParseIdentities(data)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/patrickfnielsen/gear/internal/state"
+)
+
+// statusCommand shows the deployed commit and projects of each repository, from the deployment state.
+// The exit code is exitChanges if the last deployment of any repository failed, a rollback is not a failure
+func statusCommand(c *cli, args []string) int {
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	cfg, _, err := c.load(false)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	targets, err := c.targets(cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	code := exitOK
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, t := range targets {
+		deploymentState := state.LoadDeploymentState(t.stateFile)
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		fmt.Fprintf(w, "repository:\t%s\n", t.name())
+		fmt.Fprintf(w, "state file:\t%s\n", t.stateFile)
+		if deploymentState.CurrentHash == "" {
+			fmt.Fprintf(w, "deployed:\tnothing deployed\n")
+		} else {
+			fmt.Fprintf(w, "deployed:\t%s\n", formatCommit(deploymentState.CurrentHash, deploymentState.CurrentRef))
+		}
+
+		if deploymentState.FailedHash != "" {
+			fmt.Fprintf(w, "failed:\t%s\n", deploymentState.FailedHash)
+			code = exitChanges
+		}
+
+		if deploymentState.RolledBackHash != "" {
+			fmt.Fprintf(w, "rolled back:\t%s\n", deploymentState.RolledBackHash)
+		}
+
+		var projectNames []string
+		for name := range deploymentState.Projects {
+			projectNames = append(projectNames, name)
+		}
+		sort.Strings(projectNames)
+
+		for _, name := range projectNames {
+			project := deploymentState.Projects[name]
+			fmt.Fprintf(w, "project:\t%s\t%s\n", name, strings.Join(slices.Concat(project.Files, project.EnvFiles), ", "))
+		}
+	}
+
+	w.Flush()
+	return code
+}
+
+// historyCommand shows the deployments of each repository, newest first
+func historyCommand(c *cli, args []string) int {
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	cfg, _, err := c.load(false)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	targets, err := c.targets(cfg)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tTIME\tSTATUS\tCOMMIT")
+	for _, t := range targets {
+		history := state.LoadDeploymentState(t.stateFile).History
+		for i := len(history) - 1; i >= 0; i-- {
+			record := history[i]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.name(), record.Time.Local().Format(time.RFC3339), record.Status, formatCommit(record.Hash, record.Ref))
+		}
+	}
+
+	w.Flush()
+	return exitOK
+}
+
+// formatCommit returns the commit hash, with the ref if it's not the hash itself
+func formatCommit(hash string, ref string) string {
+	if ref == "" || ref == hash {
+		return hash
+	}
+
+	return fmt.Sprintf("%s (%s)", hash, ref)
+}
@@ -6,8 +6,11 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func LoadConfig() (*Config, error) {
-	data, err := os.ReadFile("config.yaml")
+// DefaultFileName is the config file used when no other file is given
+const DefaultFileName = "config.yaml"
+
+func LoadConfig(fileName string) (*Config, error) {
+	data, err := os.ReadFile(fileName)
 	if err != nil {
 		return nil, err
 	}
@@ -17,7 +20,12 @@ func LoadConfig() (*Config, error) {
 		Environment:  "PROD",
 		SyncInterval: 60,
 		Deployment: DeploymentConfig{
-			Directory: "./deployments",
+			Directory:        "./deployments",
+			SecretsDirectory: "/dev/shm/gear",
+			HealthTimeout:    120,
+		},
+		Webhook: WebhookConfig{
+			Path: "/webhook",
 		},
 	}
 	err = yaml.Unmarshal([]byte(data), &config)
@@ -25,5 +33,35 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	// the label overrides are layered in the order the labels are listed, which the map doesn't keep
+	var labels struct {
+		Labels yaml.Node `yaml:"labels"`
+	}
+	err = yaml.Unmarshal(data, &labels)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i+1 < len(labels.Labels.Content); i += 2 {
+		config.LabelOrder = append(config.LabelOrder, labels.Labels.Content[i].Value)
+	}
+
+	// a single repository can still be configured using "repository"
+	if config.Repository.Url != "" {
+		config.Repositories = append([]RepoConfig{config.Repository}, config.Repositories...)
+	}
+
+	for i := range config.SecretProviders {
+		if config.SecretProviders[i].KVVersion == 0 {
+			config.SecretProviders[i].KVVersion = 2
+		}
+	}
+
+	for i := range config.Repositories {
+		if config.Repositories[i].SyncInterval == 0 {
+			config.Repositories[i].SyncInterval = config.SyncInterval
+		}
+	}
+
 	return &config, config.Validate()
 }
@@ -1,24 +1,117 @@
 package config
 
-import "errors"
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
 
 type RepoConfig struct {
-	Url                string `yaml:"url"`
-	Branch             string `yaml:"branch"`
-	SSHKeyFile         string `yaml:"ssh_key_file"`
-	OverrideIdentifier string `yaml:"override_identifier"`
+	Name               string   `yaml:"name"`
+	Url                string   `yaml:"url"`
+	Branch             string   `yaml:"branch"`
+	Tag                string   `yaml:"tag"`
+	Commit             string   `yaml:"commit"`
+	AllowDowngrade     bool     `yaml:"allow_downgrade"`
+	Path               string   `yaml:"path"`
+	CacheDirectory     string   `yaml:"cache_directory"`
+	Include            []string `yaml:"include"`
+	Exclude            []string `yaml:"exclude"`
+	SSHKeyFile         string   `yaml:"ssh_key_file"`
+	Username           string   `yaml:"username"`
+	TokenFile          string   `yaml:"token_file"`
+	TokenEnv           string   `yaml:"token_env"`
+	OverrideIdentifier string   `yaml:"override_identifier"`
+	SyncInterval       int      `yaml:"sync_interval"`
+
+	KnownHostsFile      string   `yaml:"known_hosts_file"`
+	HostKeyFingerprints []string `yaml:"host_key_fingerprints"`
+	TrustOnFirstUse     bool     `yaml:"trust_on_first_use"`
+
+	TrustedGPGKeysFile string `yaml:"trusted_gpg_keys_file"`
+	TrustedSSHKeysFile string `yaml:"trusted_ssh_keys_file"`
+}
+
+// IsHTTP returns true if the repository is accessed over http(s) instead of ssh
+func (r *RepoConfig) IsHTTP() bool {
+	return strings.HasPrefix(r.Url, "http://") || strings.HasPrefix(r.Url, "https://")
+}
+
+// SecretProviderConfig configures an external secret provider, the type is either exec or vault
+type SecretProviderConfig struct {
+	Name      string   `yaml:"name"`
+	Type      string   `yaml:"type"`
+	Command   []string `yaml:"command"`
+	Address   string   `yaml:"address"`
+	TokenFile string   `yaml:"token_file"`
+	TokenEnv  string   `yaml:"token_env"`
+	Mount     string   `yaml:"mount"`
+	KVVersion int      `yaml:"kv_version"`
+}
+
+func (p *SecretProviderConfig) Validate() error {
+	if !validName.MatchString(p.Name) {
+		return errors.New("invalid name, only lowercase letters, numbers, '-' and '_' are allowed")
+	}
+
+	switch p.Type {
+	case "exec":
+		if len(p.Command) == 0 {
+			return errors.New("invalid command")
+		}
+	case "vault":
+		if p.Address == "" {
+			return errors.New("invalid vault address")
+		}
+
+		if p.Mount == "" {
+			return errors.New("invalid vault mount")
+		}
+
+		if p.KVVersion != 1 && p.KVVersion != 2 {
+			return errors.New("invalid vault kv version, must be 1 or 2")
+		}
+
+		if (p.TokenFile == "") == (p.TokenEnv == "") {
+			return errors.New("exactly one of token file and token env must be set")
+		}
+	default:
+		return fmt.Errorf("invalid type '%s', must be exec or vault", p.Type)
+	}
+
+	return nil
 }
 
 type DeploymentConfig struct {
-	Directory string `yaml:"directory"`
+	Directory        string `yaml:"directory"`
+	SecretsDirectory string `yaml:"secrets_directory"`
+	HealthTimeout    int    `yaml:"health_timeout"`
+}
+
+type WebhookConfig struct {
+	Listen     string `yaml:"listen"`
+	Path       string `yaml:"path"`
+	SecretFile string `yaml:"secret_file"`
 }
 
 type Config struct {
-	Environment       string           `yaml:"environment"`
-	SyncInterval      int              `yaml:"sync_interval"`
-	EncryptionKeyFile string           `yaml:"encryption_key_file"`
-	Repository        RepoConfig       `yaml:"repository"`
-	Deployment        DeploymentConfig `yaml:"deployment"`
+	Environment       string                 `yaml:"environment"`
+	SyncInterval      int                    `yaml:"sync_interval"`
+	EncryptionKeyFile string                 `yaml:"encryption_key_file"`
+	Repository        RepoConfig             `yaml:"repository"`
+	Repositories      []RepoConfig           `yaml:"repositories"`
+	Labels            map[string]string      `yaml:"labels"`
+	Variables         map[string]string      `yaml:"variables"`
+	SecretProviders   []SecretProviderConfig `yaml:"secret_providers"`
+	Deployment        DeploymentConfig       `yaml:"deployment"`
+	Webhook           WebhookConfig          `yaml:"webhook"`
+
+	// the label keys in the order they are listed, which is the order the label overrides are layered in
+	LabelOrder []string `yaml:"-"`
 }
 
 func (c *Config) Validate() error {
@@ -27,17 +120,121 @@ func (c *Config) Validate() error {
 		return errors.New("invalid deployment directory")
 	}
 
-	if c.Repository.Branch == "" {
-		return errors.New("invalid branch")
+	if c.Deployment.SecretsDirectory == "" {
+		return errors.New("invalid secrets directory")
+	}
+
+	if len(c.Repositories) == 0 {
+		return errors.New("no repositories configured")
+	}
+
+	// each repository needs a unique name, so their deployments don't collide
+	names := make(map[string]bool)
+	for i := range c.Repositories {
+		repo := &c.Repositories[i]
+		if len(c.Repositories) > 1 && repo.Name == "" {
+			return errors.New("invalid repository name, a name is required when using multiple repositories")
+		}
+
+		if names[repo.Name] {
+			return fmt.Errorf("duplicate repository name '%s'", repo.Name)
+		}
+		names[repo.Name] = true
+
+		if err := repo.Validate(); err != nil {
+			return fmt.Errorf("repository '%s': %w", repo.Url, err)
+		}
+	}
+
+	// labels are used in customise directory names, as <key>=<value>
+	for key, value := range c.Labels {
+		if key == "" || value == "" || strings.ContainsAny(key, "=/") || strings.Contains(value, "/") {
+			return fmt.Errorf("invalid label '%s=%s'", key, value)
+		}
+	}
+
+	providers := make(map[string]bool)
+	for i := range c.SecretProviders {
+		provider := &c.SecretProviders[i]
+		if providers[provider.Name] {
+			return fmt.Errorf("duplicate secret provider name '%s'", provider.Name)
+		}
+		providers[provider.Name] = true
+
+		if err := provider.Validate(); err != nil {
+			return fmt.Errorf("secret provider '%s': %w", provider.Name, err)
+		}
+	}
+
+	if c.Deployment.HealthTimeout <= 0 {
+		return errors.New("invalid health timeout")
+	}
+
+	// the webhook is optional, but when enabled it must be able to verify requests
+	if c.Webhook.Listen != "" && c.Webhook.SecretFile == "" {
+		return errors.New("invalid webhook secret")
+	}
+
+	return nil
+}
+
+func (r *RepoConfig) Validate() error {
+	if r.Name != "" && !validName.MatchString(r.Name) {
+		return errors.New("invalid name, only lowercase letters, numbers, '-' and '_' are allowed")
+	}
+
+	// exactly one of branch, tag, or commit selects what to deploy
+	revisions := 0
+	for _, revision := range []string{r.Branch, r.Tag, r.Commit} {
+		if revision != "" {
+			revisions++
+		}
+	}
+
+	if revisions != 1 {
+		return errors.New("invalid revision, exactly one of branch, tag, or commit must be set")
+	}
+
+	if strings.ContainsAny(r.OverrideIdentifier, "=/") {
+		return errors.New("invalid override identifier")
+	}
+
+	if r.Commit != "" && !isCommitHash(r.Commit) {
+		return errors.New("invalid commit, must be a full commit hash")
 	}
 
-	if c.Repository.SSHKeyFile == "" {
+	if !r.IsHTTP() && r.SSHKeyFile == "" {
 		return errors.New("invalid ssh key")
 	}
 
-	if c.Repository.Url == "" {
+	if strings.Contains(r.Path, "..") {
+		return errors.New("invalid repository path")
+	}
+
+	if r.TrustOnFirstUse && r.KnownHostsFile == "" {
+		return errors.New("trust on first use requires a known hosts file")
+	}
+
+	if r.TokenFile != "" && r.TokenEnv != "" {
+		return errors.New("only one of token file and token env can be set")
+	}
+
+	if r.Url == "" {
 		return errors.New("invalid repository url")
 	}
 
+	if r.SyncInterval <= 0 {
+		return errors.New("invalid sync interval")
+	}
+
 	return nil
 }
+
+func isCommitHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -2,12 +2,13 @@ package deploy
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path"
-	"regexp"
 	"strings"
 	"time"
 
+	"github.com/compose-spec/compose-go/dotenv"
 	"github.com/compose-spec/compose-go/loader"
 	"github.com/compose-spec/compose-go/types"
 	"github.com/docker/cli/cli/command"
@@ -19,7 +20,8 @@ import (
 
 type ComposeService struct {
 	api.Service
-	project *types.Project
+	project   *types.Project
+	apiClient client.APIClient
 }
 
 func NewComposeService(ops ...command.DockerCliOption) (*ComposeService, error) {
@@ -40,7 +42,7 @@ func NewComposeService(ops ...command.DockerCliOption) (*ComposeService, error)
 	}
 
 	service := compose.NewComposeService(cli)
-	return &ComposeService{service, nil}, nil
+	return &ComposeService{Service: service, apiClient: apiClient}, nil
 }
 
 func (s *ComposeService) SetProject(project *types.Project) {
@@ -58,10 +60,17 @@ func (s *ComposeService) SetProject(project *types.Project) {
 	}
 }
 
-func (s *ComposeService) ComposeUp(ctx context.Context) error {
+// ComposeUp creates and starts the project, when forceRecreate is set all containers are recreated even if they haven't changed
+func (s *ComposeService) ComposeUp(ctx context.Context, forceRecreate bool) error {
+	recreate := api.RecreateDiverged
+	if forceRecreate {
+		recreate = api.RecreateForce
+	}
+
 	return s.Up(ctx, s.project, api.UpOptions{
 		Create: api.CreateOptions{
-			Timeout: getComposeTimeout(),
+			Recreate: recreate,
+			Timeout:  getComposeTimeout(),
 		},
 		Start: api.StartOptions{
 			WaitTimeout: *getComposeTimeout(),
@@ -97,7 +106,7 @@ func (s *ComposeService) ComposePull(ctx context.Context) error {
 	return s.Pull(ctx, s.project, api.PullOptions{})
 }
 
-func GetComposeProject(projectName, workDir string, files []string, skipNormalization bool) (*types.Project, error) {
+func GetComposeProject(projectName, workDir string, files []string, environment map[string]string, skipNormalization bool) (*types.Project, error) {
 	configFiles, err := getConfigFiles(workDir, files)
 	if err != nil {
 		return nil, err
@@ -106,12 +115,9 @@ func GetComposeProject(projectName, workDir string, files []string, skipNormaliz
 	details := types.ConfigDetails{
 		WorkingDir:  workDir,
 		ConfigFiles: configFiles,
-		Environment: make(map[string]string),
+		Environment: environment,
 	}
 
-	projectName = strings.ToLower(projectName)
-	reg, _ := regexp.Compile(`[^a-z0-9_-]+`)
-	projectName = reg.ReplaceAllString(projectName, "")
 	project, err := loader.Load(details, func(options *loader.Options) {
 		options.SetProjectName(projectName, true)
 		options.ResolvePaths = true
@@ -139,6 +145,20 @@ func getConfigFiles(workDir string, files []string) ([]types.ConfigFile, error)
 	return configFiles, nil
 }
 
+// getEnvironment reads the variables used for interpolation from the env files, later files take precedence
+func getEnvironment(envFiles []string) (map[string]string, error) {
+	if len(envFiles) == 0 {
+		return make(map[string]string), nil
+	}
+
+	environment, err := dotenv.Read(envFiles...)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read env files"))
+	}
+
+	return environment, nil
+}
+
 func getComposeTimeout() *time.Duration {
 	timeout := time.Minute * time.Duration(10)
 	return &timeout
@@ -0,0 +1,69 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/compose-spec/compose-go/loader"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+	"gopkg.in/yaml.v3"
+)
+
+// knownFiles are files in the bundle that are used by gear itself, and not by any runtime
+var knownFiles = []string{".gearignore"}
+
+// isComposeFile returns true if the file is a compose file, this is any yaml
+// file with a top level services key. Invalid yaml is returned as an error, so a
+// broken compose file doesn't cause the runtime to be removed
+func (d *RuntimeActivator) isComposeFile(file *gitops.BundleFile) (bool, error) {
+	if ext := path.Ext(file.FileName); ext != ".yaml" && ext != ".yml" {
+		return false, nil
+	}
+
+	content, err := loader.ParseYAML(file.Data)
+	if err != nil {
+		// valid yaml that isn't a mapping can't be a compose file
+		var value interface{}
+		if yaml.Unmarshal(file.Data, &value) == nil {
+			return false, nil
+		}
+
+		return false, errors.Join(err, fmt.Errorf("invalid yaml file '%s'", file.FileName))
+	}
+
+	_, ok := content["services"].(map[string]interface{})
+	return ok, nil
+}
+
+// unusedFiles returns the files in the bundle that are not used by any runtime,
+// the used paths are relative to the deployment directory and can be directories
+func unusedFiles(files []gitops.BundleFile, used []string) []string {
+	var unused []string
+	for _, file := range files {
+		if file.IsCustomisation || isUsedFile(file.FileName, used) {
+			continue
+		}
+
+		unused = append(unused, file.FileName)
+	}
+
+	return unused
+}
+
+func isUsedFile(fileName string, used []string) bool {
+	for _, known := range knownFiles {
+		if fileName == known {
+			return true
+		}
+	}
+
+	for _, usedPath := range used {
+		if fileName == usedPath || strings.HasPrefix(fileName, usedPath+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+package deploy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/compose-spec/compose-go/types"
+)
+
+// projectDigest returns a digest of every input a compose project is built from,
+// this is the compose files themself, and any file inside the deployment directory
+// referenced by the project (env files, bind mounts, configs and secrets).
+// The files are relative to the deployment directory
+func projectDigest(directory string, project *types.Project, files []string) (string, error) {
+	inputs := append([]string{}, files...)
+	inputs = append(inputs, projectReferences(directory, project)...)
+	sort.Strings(inputs)
+
+	hash := sha256.New()
+	for i, input := range inputs {
+		if i > 0 && inputs[i-1] == input {
+			continue
+		}
+
+		err := filepath.WalkDir(filepath.Join(directory, input), func(fileName string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			data, err := os.ReadFile(fileName)
+			if err != nil {
+				return err
+			}
+
+			// include the relative name, so moving content between files is also detected
+			relName, _ := filepath.Rel(directory, fileName)
+			hash.Write([]byte(filepath.ToSlash(relName)))
+			hash.Write([]byte{0})
+			hash.Write(data)
+			hash.Write([]byte{0})
+			return nil
+		})
+		if err != nil {
+			return "", errors.Join(err, errors.New("failed to read project input"))
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// projectReferences returns all paths referenced by the project, that are located inside
+// the deployment directory. The paths are relative to the deployment directory
+func projectReferences(directory string, project *types.Project) []string {
+	var paths []string
+	absDirectory, _ := filepath.Abs(directory)
+	add := func(source string) {
+		if source == "" {
+			return
+		}
+
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(project.WorkingDir, source)
+		}
+
+		source, _ = filepath.Abs(source)
+		relPath, err := filepath.Rel(absDirectory, source)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, "../") {
+			return
+		}
+
+		paths = append(paths, relPath)
+	}
+
+	for _, service := range project.Services {
+		for _, envFile := range service.EnvFile {
+			add(envFile)
+		}
+
+		for _, volume := range service.Volumes {
+			if volume.Type == types.VolumeTypeBind {
+				add(volume.Source)
+			}
+		}
+	}
+
+	for _, config := range project.Configs {
+		add(config.File)
+	}
+
+	for _, secret := range project.Secrets {
+		add(secret.File)
+	}
+
+	return paths
+}
@@ -0,0 +1,231 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	composetypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/compose/v2/pkg/api"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"gopkg.in/yaml.v3"
+)
+
+// gearExtensionKey is the compose extension used for gear specific service settings
+const gearExtensionKey = "x-gear"
+
+const healthCheckInterval = time.Second * 2
+
+// errUnhealthy is joined to health errors a container won't recover from, so the wait stops right away
+var errUnhealthy = errors.New("runtime is unhealthy")
+
+type gearExtension struct {
+	Probe *probeConfig `yaml:"probe"`
+}
+
+// probeConfig is a gear level probe, used to check the health of a service.
+// Only one of the probe types should be set
+type probeConfig struct {
+	HTTP string   `yaml:"http"`
+	TCP  string   `yaml:"tcp"`
+	Exec []string `yaml:"exec"`
+}
+
+// ComposeWaitHealthy waits for all containers in the project to be running and healthy,
+// using both the docker healthcheck and any probe defined in the x-gear extension
+func (s *ComposeService) ComposeWaitHealthy(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		err := s.checkHealth(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if errors.Is(err, errUnhealthy) {
+			return errors.Join(err, fmt.Errorf("runtime '%s' is not healthy", s.project.Name))
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, fmt.Errorf("runtime '%s' did not become healthy within %s", s.project.Name, timeout))
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ComposeService) checkHealth(ctx context.Context) error {
+	for _, service := range s.project.Services {
+		containers, err := s.apiClient.ContainerList(ctx, container.ListOptions{
+			All: true,
+			Filters: filters.NewArgs(
+				filters.Arg("label", fmt.Sprintf("%s=%s", api.ProjectLabel, s.project.Name)),
+				filters.Arg("label", fmt.Sprintf("%s=%s", api.ServiceLabel, service.Name)),
+			),
+		})
+		if err != nil {
+			return errors.Join(err, errors.New("failed to list containers"))
+		}
+
+		// services scaled to zero have no containers
+		if len(containers) == 0 {
+			if service.Deploy != nil && service.Deploy.Replicas != nil && *service.Deploy.Replicas == 0 {
+				continue
+			}
+
+			return fmt.Errorf("no containers found for service '%s'", service.Name)
+		}
+
+		probe, err := getServiceProbe(service)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range containers {
+			info, err := s.apiClient.ContainerInspect(ctx, c.ID)
+			if err != nil {
+				return errors.Join(err, errors.New("failed to inspect container"))
+			}
+
+			// containers of services that are not restarted, like migrations, are done once they exit successfully
+			if !info.State.Running && !isRestarted(service) && info.State.Status == "exited" {
+				if info.State.ExitCode == 0 {
+					continue
+				}
+
+				return errors.Join(errUnhealthy, fmt.Errorf("container '%s' exited with code %d", info.Name, info.State.ExitCode))
+			}
+
+			if !info.State.Running {
+				return fmt.Errorf("container '%s' is not running, status: %s", info.Name, info.State.Status)
+			}
+
+			if info.State.Health != nil && info.State.Health.Status == types.Unhealthy {
+				return errors.Join(errUnhealthy, fmt.Errorf("container '%s' is unhealthy", info.Name))
+			}
+
+			if info.State.Health != nil && info.State.Health.Status != types.Healthy {
+				return fmt.Errorf("container '%s' is not healthy, status: %s", info.Name, info.State.Health.Status)
+			}
+
+			if probe != nil && len(probe.Exec) > 0 {
+				if err := s.execProbe(ctx, c.ID, probe.Exec); err != nil {
+					return errors.Join(err, fmt.Errorf("exec probe failed for container '%s'", info.Name))
+				}
+			}
+		}
+
+		if probe != nil && probe.HTTP != "" {
+			if err := httpProbe(ctx, probe.HTTP); err != nil {
+				return errors.Join(err, fmt.Errorf("http probe failed for service '%s'", service.Name))
+			}
+		}
+
+		if probe != nil && probe.TCP != "" {
+			if err := tcpProbe(ctx, probe.TCP); err != nil {
+				return errors.Join(err, fmt.Errorf("tcp probe failed for service '%s'", service.Name))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *ComposeService) execProbe(ctx context.Context, containerID string, cmd []string) error {
+	exec, err := s.apiClient.ContainerExecCreate(ctx, containerID, types.ExecConfig{Cmd: cmd})
+	if err != nil {
+		return err
+	}
+
+	if err := s.apiClient.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{Detach: true}); err != nil {
+		return err
+	}
+
+	for {
+		result, err := s.apiClient.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return err
+		}
+
+		if !result.Running {
+			if result.ExitCode != 0 {
+				return fmt.Errorf("command exited with code %d", result.ExitCode)
+			}
+
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+}
+
+func httpProbe(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func tcpProbe(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// isRestarted returns true if docker restarts the containers of the service when they exit
+func isRestarted(service composetypes.ServiceConfig) bool {
+	if service.Deploy != nil && service.Deploy.RestartPolicy != nil {
+		return service.Deploy.RestartPolicy.Condition != "none"
+	}
+
+	return service.Restart != "" && service.Restart != composetypes.RestartPolicyNo
+}
+
+func getServiceProbe(service composetypes.ServiceConfig) (*probeConfig, error) {
+	extension, ok := service.Extensions[gearExtensionKey]
+	if !ok {
+		return nil, nil
+	}
+
+	// round trip the extension through yaml, to get it into a typed struct
+	data, err := yaml.Marshal(extension)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read x-gear extension"))
+	}
+
+	var gear gearExtension
+	if err := yaml.Unmarshal(data, &gear); err != nil {
+		return nil, errors.Join(err, fmt.Errorf("invalid x-gear extension for service '%s'", service.Name))
+	}
+
+	return gear.Probe, nil
+}
@@ -0,0 +1,137 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/compose-spec/compose-go/types"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+)
+
+const (
+	ChangeAdded    = "added"
+	ChangeModified = "modified"
+	ChangeRemoved  = "removed"
+	// ChangeUnknown is used for secrets of the deployed bundle, that are no longer available to compare with
+	ChangeUnknown = "unknown"
+)
+
+// FileChange is a file that differs between the deployed bundle and a new bundle
+type FileChange struct {
+	FileName string
+	Status   string
+	IsSecret bool
+	Old      []byte
+	New      []byte
+}
+
+// LoadBundle writes the bundle to the deployment directory and loads all its projects,
+// without deploying anything. It's used to validate a bundle before it's deployed
+func (d *RuntimeActivator) LoadBundle(bundle *gitops.Bundle) ([]*types.Project, error) {
+	err := d.persistBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleProjects, err := d.getBundleProjects(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	directory := path.Join(d.deploymentDirectory, bundle.Hash)
+	var projects []*types.Project
+	for _, bundleProject := range bundleProjects {
+		project, err := d.loadComposeProject(bundleProject.Name, directory, bundleProject.Files, bundleProject.EnvFiles, false)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to load project "+bundleProject.Name))
+		}
+
+		projects = append(projects, project)
+	}
+
+	return projects, nil
+}
+
+// DiffBundle compares the files of the bundle with the files of the deployed bundle, the
+// changes are sorted by file name
+func (d *RuntimeActivator) DiffBundle(bundle *gitops.Bundle) ([]FileChange, error) {
+	deployed, err := d.readDeployedFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []FileChange
+	for _, dep := range bundle.Files {
+		fileName := strings.TrimPrefix(path.Clean("/"+dep.FileName), "/")
+		old, found := deployed[fileName]
+		delete(deployed, fileName)
+
+		switch {
+		case !found:
+			changes = append(changes, FileChange{FileName: fileName, Status: ChangeAdded, IsSecret: dep.IsSecret, New: dep.Data})
+		case old.data == nil:
+			changes = append(changes, FileChange{FileName: fileName, Status: ChangeUnknown, IsSecret: true, New: dep.Data})
+		case !bytes.Equal(old.data, dep.Data):
+			changes = append(changes, FileChange{FileName: fileName, Status: ChangeModified, IsSecret: dep.IsSecret || old.isSecret, Old: old.data, New: dep.Data})
+		}
+	}
+
+	for fileName, old := range deployed {
+		changes = append(changes, FileChange{FileName: fileName, Status: ChangeRemoved, IsSecret: old.isSecret, Old: old.data})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].FileName < changes[j].FileName
+	})
+
+	return changes, nil
+}
+
+type deployedFile struct {
+	data     []byte
+	isSecret bool
+}
+
+// readDeployedFiles reads the files of the deployed bundle, by their name in the bundle. Secrets are
+// symlinks to the secrets directory, if they have been removed the data of the file is nil
+func (d *RuntimeActivator) readDeployedFiles() (map[string]deployedFile, error) {
+	files := make(map[string]deployedFile)
+	if d.state.CurrentHash == "" {
+		return files, nil
+	}
+
+	directory := path.Join(d.deploymentDirectory, d.state.CurrentHash)
+	err := filepath.WalkDir(directory, func(fileName string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && fileName == directory {
+			return filepath.SkipDir
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relName, err := filepath.Rel(directory, fileName)
+		if err != nil {
+			return err
+		}
+
+		isSecret := entry.Type()&fs.ModeSymlink != 0
+		data, err := os.ReadFile(fileName)
+		if err != nil && !(isSecret && errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+
+		files[filepath.ToSlash(relName)] = deployedFile{data: data, isSecret: isSecret}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read deployed bundle"))
+	}
+
+	return files, nil
+}
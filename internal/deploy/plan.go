@@ -0,0 +1,369 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/compose-spec/compose-go/types"
+	"github.com/docker/compose/v2/pkg/api"
+	"github.com/docker/compose/v2/pkg/compose"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	PlanCreate    = "create"
+	PlanRecreate  = "recreate"
+	PlanRemove    = "remove"
+	PlanUnchanged = "unchanged"
+	// PlanOrphaned is used for containers of services that are removed from a project, compose
+	// doesn't remove them when the project is updated, so they keep running
+	PlanOrphaned = "orphaned"
+)
+
+// Plan is what would change if a bundle was deployed
+type Plan struct {
+	CurrentHash string        `json:"current_hash"`
+	NewHash     string        `json:"new_hash"`
+	Projects    []ProjectPlan `json:"projects"`
+}
+
+type ProjectPlan struct {
+	Name     string        `json:"name"`
+	Action   string        `json:"action"`
+	Services []ServicePlan `json:"services,omitempty"`
+}
+
+type ServicePlan struct {
+	Name    string          `json:"name"`
+	Action  string          `json:"action"`
+	Changes []ServiceChange `json:"changes,omitempty"`
+}
+
+// ServiceChange is a changed setting of a service, compared with the deployed bundle.
+// Only the names of environment variables are included, never the values
+type ServiceChange struct {
+	Field   string   `json:"field"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+// HasChanges returns true if any project would be created, recreated or removed
+func (p *Plan) HasChanges() bool {
+	for _, project := range p.Projects {
+		if project.Action != PlanUnchanged {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Plan returns what would change if the bundle was deployed, without changing anything. The bundle is
+// written to the scratch directory, and compared with the deployed bundle and the running containers.
+// Projects are recreated the same way as when deploying, if any of their files changed, and a service
+// is recreated if compose would recreate its containers, except for changes to the image digest
+func (d *RuntimeActivator) Plan(ctx context.Context, bundle *gitops.Bundle, scratchDirectory string) (*Plan, error) {
+	scratch := NewRuntimeActivator(d.namespace, path.Join(scratchDirectory, "deployments"), path.Join(scratchDirectory, "secrets"), "", 0, d.state)
+	if err := scratch.persistBundle(bundle); err != nil {
+		return nil, err
+	}
+
+	bundleProjects, err := scratch.getBundleProjects(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer apiClient.Close()
+
+	plan := &Plan{CurrentHash: d.state.CurrentHash, NewHash: bundle.Hash}
+	missingSecrets := d.missingSecrets()
+	newDirectory := path.Join(scratch.deploymentDirectory, bundle.Hash)
+	var names []string
+	for _, bundleProject := range bundleProjects {
+		project, err := scratch.loadComposeProject(bundleProject.Name, newDirectory, bundleProject.Files, bundleProject.EnvFiles, false)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to load project "+bundleProject.Name))
+		}
+
+		inputs := append(slices.Clone(bundleProject.Files), bundleProject.EnvFiles...)
+		digest, err := projectDigest(newDirectory, project, inputs)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to get runtime digest"))
+		}
+
+		names = append(names, bundleProject.Name)
+
+		projectPlan := ProjectPlan{Name: bundleProject.Name, Action: PlanRecreate}
+		if !slices.Contains(d.state.DeployedServices, bundleProject.Name) {
+			projectPlan.Action = PlanCreate
+		} else if current, ok := d.state.Projects[bundleProject.Name]; ok && current.Digest == digest && !missingSecrets[bundleProject.Name] {
+			projectPlan.Action = PlanUnchanged
+		}
+
+		if projectPlan.Action != PlanUnchanged {
+			projectPlan.Services, err = d.planServices(ctx, apiClient, scratch, project, bundle.Hash, missingSecrets[bundleProject.Name])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		plan.Projects = append(plan.Projects, projectPlan)
+	}
+
+	// projects that are no longer part of the bundle are stopped
+	for _, projectName := range d.state.DeployedServices {
+		if slices.Contains(names, projectName) {
+			continue
+		}
+
+		containers, err := listProjectContainers(ctx, apiClient, projectName)
+		if err != nil {
+			return nil, err
+		}
+
+		var services []ServicePlan
+		for _, serviceName := range sortedKeys(containers) {
+			services = append(services, ServicePlan{Name: serviceName, Action: PlanRemove})
+		}
+
+		plan.Projects = append(plan.Projects, ProjectPlan{Name: projectName, Action: PlanRemove, Services: services})
+	}
+
+	return plan, nil
+}
+
+// planServices compares the services of a project with its running containers, to find the services compose
+// would create or recreate, and with the deployed bundle to find the settings that changed. The project is
+// loaded from the scratch directory, and compared as if it was loaded from the deployment directory. When
+// forceRecreate is set, the containers are recreated even if they haven't changed
+func (d *RuntimeActivator) planServices(ctx context.Context, apiClient client.APIClient, scratch *RuntimeActivator, project *types.Project, hash string, forceRecreate bool) ([]ServicePlan, error) {
+	containers, err := listProjectContainers(ctx, apiClient, project.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	newDirectory, newSecretsDirectory, err := scratch.absDirectories(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	deployDirectory, secretsDirectory, err := d.absDirectories(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// the deployed files might not be available anymore, like secrets that were removed when gear stopped
+	oldDirectory := path.Join(d.deploymentDirectory, d.state.CurrentHash)
+	var oldProject *types.Project
+	if d.state.CurrentHash != "" && slices.Contains(d.state.DeployedServices, project.Name) {
+		oldProject, err = d.loadComposeProject(project.Name, oldDirectory, d.state.ProjectFiles(project.Name), d.state.Projects[project.Name].EnvFiles, false)
+		if err != nil {
+			slog.Warn("failed to load deployed project, changes to services are not shown", slog.String("runtime", project.Name), slog.String("error", err.Error()))
+		}
+	}
+
+	var services []ServicePlan
+	for _, service := range project.Services {
+		// the containers are labelled with the hash of the service, as it's loaded from the deployment directory
+		mounted, err := scratch.mountServiceSecrets(service, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		mounted = relocateService(relocateService(mounted, newDirectory, deployDirectory), newSecretsDirectory, secretsDirectory)
+		configHash, err := compose.ServiceHash(mounted)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to get service hash"))
+		}
+
+		servicePlan := ServicePlan{Name: service.Name, Action: PlanUnchanged}
+		if len(containers[service.Name]) == 0 {
+			servicePlan.Action = PlanCreate
+		}
+
+		for _, c := range containers[service.Name] {
+			if c.Labels[api.ConfigHashLabel] != configHash || forceRecreate {
+				servicePlan.Action = PlanRecreate
+			}
+		}
+
+		if oldProject != nil {
+			if oldService, err := oldProject.GetService(service.Name); err == nil {
+				servicePlan.Changes = serviceChanges(oldService, oldDirectory, service, newDirectory)
+			}
+		}
+
+		services = append(services, servicePlan)
+	}
+
+	for _, serviceName := range sortedKeys(containers) {
+		if _, err := project.GetService(serviceName); err != nil {
+			services = append(services, ServicePlan{Name: serviceName, Action: PlanOrphaned})
+		}
+	}
+
+	return services, nil
+}
+
+// serviceChanges returns the changes to the image, environment, ports and volumes of a service
+func serviceChanges(old types.ServiceConfig, oldDirectory string, new types.ServiceConfig, newDirectory string) []ServiceChange {
+	var changes []ServiceChange
+	if old.Image != new.Image {
+		changes = append(changes, ServiceChange{Field: "image", Added: []string{new.Image}, Removed: []string{old.Image}})
+	}
+
+	environment := ServiceChange{Field: "environment"}
+	for name, value := range new.Environment {
+		oldValue, found := old.Environment[name]
+		switch {
+		case !found:
+			environment.Added = append(environment.Added, name)
+		case (value == nil) != (oldValue == nil) || (value != nil && *value != *oldValue):
+			environment.Changed = append(environment.Changed, name)
+		}
+	}
+	for name := range old.Environment {
+		if _, found := new.Environment[name]; !found {
+			environment.Removed = append(environment.Removed, name)
+		}
+	}
+
+	var oldPorts, newPorts []string
+	for _, port := range old.Ports {
+		oldPorts = append(oldPorts, formatPort(port))
+	}
+	for _, port := range new.Ports {
+		newPorts = append(newPorts, formatPort(port))
+	}
+
+	var oldVolumes, newVolumes []string
+	for _, volume := range old.Volumes {
+		oldVolumes = append(oldVolumes, formatVolume(volume, oldDirectory))
+	}
+	for _, volume := range new.Volumes {
+		newVolumes = append(newVolumes, formatVolume(volume, newDirectory))
+	}
+
+	for _, change := range []ServiceChange{environment, listChange("ports", oldPorts, newPorts), listChange("volumes", oldVolumes, newVolumes)} {
+		if len(change.Added)+len(change.Removed)+len(change.Changed) == 0 {
+			continue
+		}
+
+		sort.Strings(change.Added)
+		sort.Strings(change.Removed)
+		sort.Strings(change.Changed)
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// listChange returns the values added and removed between two lists
+func listChange(field string, old []string, new []string) ServiceChange {
+	change := ServiceChange{Field: field}
+	for _, value := range new {
+		if !slices.Contains(old, value) {
+			change.Added = append(change.Added, value)
+		}
+	}
+	for _, value := range old {
+		if !slices.Contains(new, value) {
+			change.Removed = append(change.Removed, value)
+		}
+	}
+
+	return change
+}
+
+func formatPort(port types.ServicePortConfig) string {
+	published := port.Published
+	if port.HostIP != "" {
+		published = port.HostIP + ":" + published
+	}
+
+	return fmt.Sprintf("%s:%d/%s", published, port.Target, port.Protocol)
+}
+
+// formatVolume formats a volume, with sources inside the deployment directory relative to it,
+// as the deployment directory is different for each commit
+func formatVolume(volume types.ServiceVolumeConfig, directory string) string {
+	source := volume.Source
+	if relSource, err := filepath.Rel(directory, source); err == nil && relSource != ".." && !strings.HasPrefix(relSource, "../") {
+		source = "./" + relSource
+	}
+
+	value := source + ":" + volume.Target
+	if volume.ReadOnly {
+		value += ":ro"
+	}
+
+	return value
+}
+
+// relocateService returns the service as if it was loaded from another directory
+func relocateService(service types.ServiceConfig, from string, to string) types.ServiceConfig {
+	relocate := func(value string) string {
+		if relValue, err := filepath.Rel(from, value); err == nil && relValue != ".." && !strings.HasPrefix(relValue, "../") {
+			return path.Join(to, relValue)
+		}
+
+		return value
+	}
+
+	service.Volumes = slices.Clone(service.Volumes)
+	for i := range service.Volumes {
+		service.Volumes[i].Source = relocate(service.Volumes[i].Source)
+	}
+
+	service.EnvFile = slices.Clone(service.EnvFile)
+	for i := range service.EnvFile {
+		service.EnvFile[i] = relocate(service.EnvFile[i])
+	}
+
+	return service
+}
+
+// listProjectContainers returns the containers of a compose project, by service name
+func listProjectContainers(ctx context.Context, apiClient client.APIClient, projectName string) (map[string][]dockertypes.Container, error) {
+	containers, err := apiClient.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%s", api.ProjectLabel, projectName))),
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to list containers"))
+	}
+
+	services := make(map[string][]dockertypes.Container)
+	for _, c := range containers {
+		serviceName := c.Labels[api.ServiceLabel]
+		services[serviceName] = append(services[serviceName], c)
+	}
+
+	return services, nil
+}
+
+func sortedKeys[T any](values map[string]T) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
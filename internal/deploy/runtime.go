@@ -5,130 +5,384 @@ import (
 	"errors"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/compose-spec/compose-go/types"
 	"github.com/docker/cli/cli/command"
 	"github.com/patrickfnielsen/gear/internal/gitops"
 	"github.com/patrickfnielsen/gear/internal/state"
 	"golang.org/x/exp/slog"
 )
 
+// rolloutChanges tracks the runtimes touched by a deployment, so they can be rolled back
+type rolloutChanges struct {
+	stopped         []string
+	started         []string
+	startedServices []*ComposeService
+}
+
+// invalidProjectName matches the characters that aren't allowed in a compose project name
+var invalidProjectName = regexp.MustCompile(`[^a-z0-9_-]+`)
+
 type RuntimeActivator struct {
+	namespace           string
 	deploymentDirectory string
+	secretsDirectory    string
+	stateFile           string
+	healthTimeout       time.Duration
 	state               *state.DeploymentState
+	// stateModTime is when the state file was last read or written, to know if another process changed it
+	stateModTime time.Time
 }
 
-func NewRuntimeActivator(directory string, state *state.DeploymentState) *RuntimeActivator {
+// NewRuntimeActivator creates an activator for the bundles of a single repository, the namespace
+// is used to keep project names and deployment directories apart when using multiple repositories
+func NewRuntimeActivator(namespace string, directory string, secretsDirectory string, stateFile string, healthTimeout time.Duration, deploymentState *state.DeploymentState) *RuntimeActivator {
 	return &RuntimeActivator{
-		deploymentDirectory: directory,
-		state:               state,
+		namespace:           namespace,
+		deploymentDirectory: path.Join(directory, namespace),
+		secretsDirectory:    path.Join(secretsDirectory, namespace),
+		stateFile:           stateFile,
+		healthTimeout:       healthTimeout,
+		state:               deploymentState,
+		stateModTime:        state.ModTime(stateFile),
+	}
+}
+
+// ReloadState reads the deployment state again if another process changed it, like a rollback while gear
+// is running. It returns the deployment state, and true if it was reloaded
+func (d *RuntimeActivator) ReloadState() (*state.DeploymentState, bool) {
+	modTime := state.ModTime(d.stateFile)
+	if modTime.Equal(d.stateModTime) {
+		return d.state, false
 	}
+
+	slog.Info("deployment state changed, reloading", slog.String("file", d.stateFile))
+	d.state = state.LoadDeploymentState(d.stateFile)
+	d.stateModTime = modTime
+	return d.state, true
 }
 
+// setState keeps the state after it's written to the state file
+func (d *RuntimeActivator) setState(deploymentState *state.DeploymentState) {
+	d.state = deploymentState
+	d.stateModTime = state.ModTime(d.stateFile)
+}
+
+// DeployUpdate activates the bundle, if any runtime fails to deploy the runtimes touched
+// are rolled back to the previous deployment, and the bundle is recorded as failed
 func (d *RuntimeActivator) DeployUpdate(ctx context.Context, bundle *gitops.Bundle) error {
+	changes := &rolloutChanges{}
+	err := d.activateBundle(ctx, bundle, changes)
+	if err == nil {
+		// the secrets of older deployments are no longer needed
+		if err := d.pruneSecrets(); err != nil {
+			slog.Warn("failed to remove old secrets", slog.String("error", err.Error()))
+		}
+
+		return nil
+	}
+
+	// the rollback isn't cancelled when gear is stopped, so the previous commit is left running
+	slog.Error("deployment failed, rolling back", slog.String("commit_hash", bundle.Hash), slog.String("error", err.Error()))
+	if rollbackErr := d.rollback(context.WithoutCancel(ctx), changes); rollbackErr != nil {
+		err = errors.Join(err, rollbackErr, errors.New("failed to rollback deployment"))
+	}
+
+	if pruneErr := d.pruneSecrets(); pruneErr != nil {
+		slog.Warn("failed to remove secrets of failed deployment", slog.String("error", pruneErr.Error()))
+	}
+
+	// a deployment stopped by a shutdown didn't fail, so it's deployed again on the next start
+	if ctx.Err() != nil {
+		return err
+	}
+
+	state, stateErr := state.SaveFailedDeployment(d.stateFile, d.state, bundle.Hash, bundle.Ref)
+	if stateErr != nil {
+		return errors.Join(err, stateErr, errors.New("unable to update deployment state"))
+	}
+
+	d.setState(state)
+	return err
+}
+
+func (d *RuntimeActivator) activateBundle(ctx context.Context, bundle *gitops.Bundle, changes *rolloutChanges) error {
 	directory := path.Join(d.deploymentDirectory, bundle.Hash)
 
+	// checked before the bundle is persisted, as it restores the secrets of the commit
+	missingSecrets := d.missingSecrets()
+
 	// write all files to disk in the folder named after the commit hash
 	err := d.persistBundle(bundle)
 	if err != nil {
 		return err
 	}
 
-	// stop all current runtimes
+	bundleProjects, err := d.getBundleProjects(bundle)
+	if err != nil {
+		return err
+	}
+
+	// load all runtimes in the new bundle, so we can compare them with the deployed ones
+	var deployed []string
+	var services []*ComposeService
+	var used []string
+	projects := make(map[string]state.DeployedProject)
+	for _, project := range bundleProjects {
+		composeProject, err := d.loadComposeProject(project.Name, directory, project.Files, project.EnvFiles, false)
+		if err != nil {
+			return errors.Join(err, errors.New("failed to load compose project"))
+		}
+
+		inputs := append(slices.Clone(project.Files), project.EnvFiles...)
+		digest, err := projectDigest(directory, composeProject, inputs)
+		if err != nil {
+			return errors.Join(err, errors.New("failed to get runtime digest"))
+		}
+
+		references := projectReferences(directory, composeProject)
+		service, err := d.newComposeService(composeProject, bundle.Hash)
+		if err != nil {
+			return errors.Join(err, errors.New("failed to get compose service"))
+		}
+
+		deployed = append(deployed, project.Name)
+		services = append(services, service)
+		projects[project.Name] = state.DeployedProject{
+			Files:         project.Files,
+			EnvFiles:      project.EnvFiles,
+			Digest:        digest,
+			Hash:          bundle.Hash,
+			MountsSecrets: d.mountsSecrets(service.project, bundle.Hash),
+		}
+		used = append(used, inputs...)
+		used = append(used, references...)
+	}
+
+	for _, fileName := range unusedFiles(bundle.Files, used) {
+		slog.Warn("file is not a compose file, or used by any runtime", slog.String("file_name", fileName))
+	}
+
+	// stop runtimes that are no longer part of the bundle
 	for _, projectName := range d.state.DeployedServices {
+		if _, ok := projects[projectName]; ok {
+			continue
+		}
+
 		slog.Info("stopping runtime", slog.String("runtime", projectName))
 
-		oldDirectory := path.Join(d.deploymentDirectory, d.state.CurrentHash)
-		service, err := d.getComposeService(projectName, oldDirectory, []string{projectName + ".yaml"}, false)
+		// only the project name is needed to down a project, so the old files aren't loaded,
+		// as the secrets they reference might not exist anymore
+		service, err := NewComposeService(command.WithCombinedStreams(LogWritter{}))
 		if err != nil {
 			return errors.Join(err, errors.New("failed to get compose service"))
 		}
 
+		service.SetProject(&types.Project{Name: projectName})
+
+		changes.stopped = append(changes.stopped, projectName)
 		err = service.ComposeDown(ctx)
 		if err != nil {
 			return errors.Join(err, errors.New("failed to down compose service"))
 		}
 	}
 
-	// startup all runtimes
-	var deployed []string
-	for _, dep := range bundle.Files {
-		if dep.IsCustomisation || !d.isComposeFile(&dep) {
-			continue
-		}
+	// startup new and changed runtimes, compose will recreate the containers that changed
+	for i, projectName := range deployed {
+		if current, ok := d.state.Projects[projectName]; ok && current.Digest == projects[projectName].Digest && !missingSecrets[projectName] {
+			slog.Info("runtime unchanged", slog.String("runtime", projectName))
 
-		projectName := strings.ReplaceAll(dep.FileName, ".yaml", "")
-		files := []string{
-			dep.FileName,
+			// the containers keep using the files of the deployment they were started from
+			project := projects[projectName]
+			project.Hash = current.Hash
+			project.MountsSecrets = current.MountsSecrets
+			projects[projectName] = project
+			continue
 		}
 
 		slog.Info("starting runtime", slog.String("runtime", projectName))
 
-		if override := d.getOverride(bundle.Files, projectName); override != nil {
-			slog.Info("found override for runtime", slog.String("override", override.FileName), slog.String("runtime", projectName))
-			files = append(files, "customise/"+override.FileName)
-		}
-
-		service, err := d.getComposeService(projectName, directory, files, false)
+		changes.started = append(changes.started, projectName)
+		changes.startedServices = append(changes.startedServices, services[i])
+		// the containers of a project mounting missing secrets are recreated, even if they haven't changed
+		err = services[i].ComposeUp(ctx, missingSecrets[projectName])
 		if err != nil {
-			return errors.Join(err, errors.New("failed to get compose service"))
+			return errors.Join(err, errors.New("failed to up compose service"))
 		}
 
-		err = service.ComposeUp(ctx)
+		slog.Info("waiting for runtime to become healthy", slog.String("runtime", projectName))
+		err = services[i].ComposeWaitHealthy(ctx, d.healthTimeout)
 		if err != nil {
-			return errors.Join(err, errors.New("failed to up compose service"))
+			return errors.Join(err, errors.New("runtime failed health check"))
 		}
 
 		slog.Info("runtime deployed", slog.String("runtime", projectName))
-		deployed = append(deployed, projectName)
 	}
 
-	state, err := state.SaveDeploymentState(bundle.Hash, deployed)
+	state, err := state.SaveDeploymentState(d.stateFile, d.state, bundle.Hash, bundle.Ref, bundle.Tree, deployed, projects)
 	if err != nil {
 		return errors.Join(err, errors.New("unable to update deployment state"))
 	}
 
-	d.state = state
+	d.setState(state)
 	return nil
 }
 
+// rollback restores the runtimes touched by a failed deployment, using the files from
+// the previous deployment directory. Runtimes that did not exist before are removed
+func (d *RuntimeActivator) rollback(ctx context.Context, changes *rolloutChanges) error {
+	var errs []error
+	for i, projectName := range changes.started {
+		if slices.Contains(d.state.DeployedServices, projectName) {
+			continue
+		}
+
+		slog.Info("removing runtime", slog.String("runtime", projectName))
+		if err := changes.startedServices[i].ComposeDown(ctx); err != nil {
+			errs = append(errs, errors.Join(err, errors.New("failed to down compose service")))
+		}
+	}
+
+	for _, projectName := range d.state.DeployedServices {
+		if !slices.Contains(changes.started, projectName) && !slices.Contains(changes.stopped, projectName) {
+			continue
+		}
+
+		slog.Info("restoring runtime", slog.String("runtime", projectName), slog.String("commit_hash", d.state.CurrentHash))
+		service, err := d.getComposeService(projectName, d.state.CurrentHash, d.state.ProjectFiles(projectName), d.state.Projects[projectName].EnvFiles, false)
+		if err != nil {
+			errs = append(errs, errors.Join(err, errors.New("failed to get compose service")))
+			continue
+		}
+
+		if err := service.ComposeUp(ctx, false); err != nil {
+			errs = append(errs, errors.Join(err, errors.New("failed to up compose service")))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
 func (d *RuntimeActivator) persistBundle(bundle *gitops.Bundle) error {
 	directory := path.Join(d.deploymentDirectory, bundle.Hash)
-	err := os.MkdirAll(directory+"/customise", os.ModePerm)
+	err := os.MkdirAll(directory, 0755)
 	if err != nil {
 		return errors.Join(err, errors.New("failed to create directory for deployment"))
 	}
 
+	// the secrets directory is created even if there are no secrets, so it's known the deployment is persisted
+	err = os.MkdirAll(path.Join(d.secretsDirectory, bundle.Hash), 0700)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to create secrets directory for deployment"))
+	}
+
 	slog.Info("persisting bundle", slog.String("commit_hash", bundle.Hash), slog.String("directory", directory))
 
 	for _, dep := range bundle.Files {
-		fileName := path.Join(directory, dep.FileName)
-		if dep.IsCustomisation {
-			fileName = path.Join(directory, "customise", dep.FileName)
+		// bundle files keep their path in the repository, so make sure it can't escape the deployment
+		fileName := path.Join(directory, path.Clean("/"+dep.FileName))
+		err := os.MkdirAll(path.Dir(fileName), 0755)
+		if err != nil {
+			return errors.Join(err, errors.New("failed to create bundle directory"))
 		}
 
-		file, err := os.Create(fileName)
-		if err != nil {
-			return errors.Join(err, errors.New("failed to create bundle file"))
+		// decrypted files are kept out of the deployment directory
+		if dep.IsSecret {
+			if err := d.persistSecret(bundle.Hash, &dep, fileName); err != nil {
+				return err
+			}
+			continue
+		}
+
+		mode := dep.Mode
+		if mode == 0 {
+			mode = 0644
 		}
 
-		_, err = file.Write(dep.Data)
+		err = os.WriteFile(fileName, dep.Data, mode)
 		if err != nil {
 			return errors.Join(err, errors.New("failed to write bundle file"))
 		}
 
+		// the file might already exist from an earlier attempt, so make sure the mode is updated
+		err = os.Chmod(fileName, mode)
+		if err != nil {
+			return errors.Join(err, errors.New("failed to set bundle file mode"))
+		}
+
 		slog.Info("persisted bundle file", slog.String("file_name", fileName))
 	}
 
 	return nil
 }
 
-func (d *RuntimeActivator) getComposeService(name, workDir string, files []string, skipNormalization bool) (*ComposeService, error) {
-	project, err := GetComposeProject(name, workDir, files, skipNormalization)
+// getBundleProjects returns the projects to deploy, in the order they should be deployed. If the bundle
+// has a manifest the projects are taken from it, otherwise each compose file in the bundle is a project
+func (d *RuntimeActivator) getBundleProjects(bundle *gitops.Bundle) ([]gitops.BundleProject, error) {
+	if bundle.Projects != nil {
+		var projects []gitops.BundleProject
+		for _, project := range bundle.Projects {
+			project.Name = d.namespaced(project.Name)
+			projects = append(projects, project)
+		}
+
+		return projects, nil
+	}
+
+	var projects []gitops.BundleProject
+	for _, dep := range bundle.Files {
+		if dep.IsCustomisation {
+			continue
+		}
+
+		isCompose, err := d.isComposeFile(&dep)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isCompose {
+			continue
+		}
+
+		projectName := d.getProjectName(dep.FileName)
+		files := []string{
+			dep.FileName,
+		}
+
+		for _, override := range d.getOverrides(bundle.Files, dep.FileName) {
+			slog.Info("found override for runtime", slog.String("override", override), slog.String("runtime", projectName))
+			files = append(files, override)
+		}
+
+		projects = append(projects, gitops.BundleProject{Name: projectName, Files: files})
+	}
+
+	return projects, nil
+}
+
+// getComposeService loads a compose project from the deployment directory of a commit, and creates the compose service for it
+func (d *RuntimeActivator) getComposeService(name, hash string, files []string, envFiles []string, skipNormalization bool) (*ComposeService, error) {
+	project, err := d.loadComposeProject(name, path.Join(d.deploymentDirectory, hash), files, envFiles, skipNormalization)
 	if err != nil {
 		return nil, err
 	}
 
+	return d.newComposeService(project, hash)
+}
+
+// newComposeService creates the compose service for a project loaded from the deployment directory of a commit,
+// the secrets it mounts are mounted from the secrets directory
+func (d *RuntimeActivator) newComposeService(project *types.Project, hash string) (*ComposeService, error) {
+	if err := d.mountSecrets(project, hash); err != nil {
+		return nil, err
+	}
+
 	logWritter := LogWritter{}
 	composeService, err := NewComposeService(command.WithCombinedStreams(logWritter))
 	if err != nil {
@@ -138,16 +392,86 @@ func (d *RuntimeActivator) getComposeService(name, workDir string, files []strin
 	return composeService, nil
 }
 
-func (d *RuntimeActivator) getOverride(deployments []gitops.BundleFile, baseName string) *gitops.BundleFile {
+// loadComposeProject loads a compose project from the deployment directory, the files are relative
+// to the deployment directory, and the project working directory is the directory of the first file.
+// The env files are used when interpolating variables in the compose files
+func (d *RuntimeActivator) loadComposeProject(name, directory string, files []string, envFiles []string, skipNormalization bool) (*types.Project, error) {
+	workDir := path.Join(directory, path.Dir(files[0]))
+	var projectFiles []string
+	for _, file := range files {
+		relFile, err := filepath.Rel(workDir, path.Join(directory, file))
+		if err != nil {
+			return nil, err
+		}
+
+		projectFiles = append(projectFiles, relFile)
+	}
+
+	var envFilePaths []string
+	for _, envFile := range envFiles {
+		envFilePaths = append(envFilePaths, path.Join(directory, envFile))
+	}
+
+	environment, err := getEnvironment(envFilePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetComposeProject(name, workDir, projectFiles, environment, skipNormalization)
+}
+
+// getOverrides returns the customisations for a compose file, the overrides are located at the same
+// path as the compose file, inside the customise/<key>=<value> and customise/<identifier> directories.
+// The bundle only contains the customisations for this host, and they are layered by their layer, the
+// label overrides first in the order the labels are listed in the config, and the host override last
+func (d *RuntimeActivator) getOverrides(deployments []gitops.BundleFile, fileName string) []string {
+	var overrides []gitops.BundleFile
 	for _, dep := range deployments {
-		if dep.IsCustomisation && strings.HasPrefix(dep.FileName, baseName) {
-			return &dep
+		if !dep.IsCustomisation {
+			continue
 		}
+
+		// strip the customise/<directory>/ prefix
+		parts := strings.SplitN(dep.FileName, "/", 3)
+		if len(parts) != 3 || parts[2] != fileName {
+			continue
+		}
+
+		overrides = append(overrides, dep)
 	}
 
-	return nil
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return overrides[i].Layer < overrides[j].Layer
+	})
+
+	var fileNames []string
+	for _, override := range overrides {
+		fileNames = append(fileNames, override.FileName)
+	}
+
+	return fileNames
 }
 
-func (d *RuntimeActivator) isComposeFile(file *gitops.BundleFile) bool {
-	return path.Ext(file.FileName) == ".yaml" && strings.HasPrefix(string(file.Data), "version:")
+// getProjectName returns the project name for a compose file, based on its path in the repository.
+// Files named compose.yaml or docker-compose.yaml use the name of the directory they are in
+func (d *RuntimeActivator) getProjectName(fileName string) string {
+	name := strings.TrimSuffix(fileName, path.Ext(fileName))
+	if base := path.Base(name); base == "compose" || base == "docker-compose" {
+		if dir := path.Dir(name); dir != "." {
+			name = dir
+		}
+	}
+
+	return d.namespaced(strings.ReplaceAll(name, "/", "-"))
+}
+
+// namespaced prefixes the project name with the namespace, so projects from different repositories don't collide.
+// The name is made a valid compose project name, so it matches the label on the containers when they are stopped
+func (d *RuntimeActivator) namespaced(name string) string {
+	if d.namespace != "" {
+		name = d.namespace + "-" + name
+	}
+
+	name = invalidProjectName.ReplaceAllString(strings.ToLower(name), "")
+	return strings.TrimLeft(name, "-_")
 }
@@ -0,0 +1,332 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/compose-spec/compose-go/types"
+	"github.com/patrickfnielsen/gear/internal/gitops"
+	"golang.org/x/exp/slog"
+)
+
+// persistSecret writes a decrypted file to the secrets directory, which should be RAM backed so secrets
+// never reach the disk. The file in the deployment directory is a symlink to the secret, so compose files
+// can reference it like any other file in the bundle
+func (d *RuntimeActivator) persistSecret(hash string, file *gitops.BundleFile, fileName string) error {
+	secretsDirectory, err := filepath.Abs(path.Join(d.secretsDirectory, hash))
+	if err != nil {
+		return errors.Join(err, errors.New("invalid secrets directory"))
+	}
+
+	secretFileName := path.Join(secretsDirectory, path.Clean("/"+file.FileName))
+	err = os.MkdirAll(path.Dir(secretFileName), 0700)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to create secrets directory"))
+	}
+
+	err = os.WriteFile(secretFileName, file.Data, 0600)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to write secret"))
+	}
+
+	// the file might already exist from an earlier attempt, so make sure the mode is updated
+	err = os.Chmod(secretFileName, 0600)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to set secret file mode"))
+	}
+
+	err = os.Remove(fileName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Join(err, errors.New("failed to remove existing bundle file"))
+	}
+
+	err = os.Symlink(secretFileName, fileName)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to link secret into bundle"))
+	}
+
+	slog.Info("persisted secret", slog.String("file_name", fileName))
+	return nil
+}
+
+// HasSecrets returns true if the secrets of the current deployment, and the secrets mounted by the deployed
+// projects exist. They are missing after a restart as they are wiped at shutdown, and the current deployment
+// must be persisted again
+func (d *RuntimeActivator) HasSecrets() bool {
+	if d.state.CurrentHash == "" {
+		return true
+	}
+
+	if _, err := os.Stat(path.Join(d.secretsDirectory, d.state.CurrentHash)); err != nil {
+		return false
+	}
+
+	return len(d.missingSecrets()) == 0
+}
+
+// missingSecrets returns the deployed projects mounting secrets that no longer exist, like after a reboot.
+// Their containers can't be started by docker, so they must be started again once the secrets are restored
+func (d *RuntimeActivator) missingSecrets() map[string]bool {
+	missing := make(map[string]bool)
+	for name, project := range d.state.Projects {
+		if !project.MountsSecrets {
+			continue
+		}
+
+		if _, err := os.Stat(path.Join(d.secretsDirectory, project.Hash)); err != nil {
+			missing[name] = true
+		}
+	}
+
+	return missing
+}
+
+// mountsSecrets returns true if the project mounts any file from the secrets directory of the commit
+func (d *RuntimeActivator) mountsSecrets(project *types.Project, hash string) bool {
+	_, secretsDirectory, err := d.absDirectories(hash)
+	if err != nil {
+		return false
+	}
+
+	for _, service := range project.Services {
+		for _, volume := range service.Volumes {
+			if _, ok := relativeTo(volume.Source, secretsDirectory); ok && volume.Type == types.VolumeTypeBind {
+				return true
+			}
+		}
+	}
+
+	for _, config := range project.Configs {
+		if _, ok := relativeTo(config.File, secretsDirectory); ok && config.File != "" {
+			return true
+		}
+	}
+
+	for _, secret := range project.Secrets {
+		if _, ok := relativeTo(secret.File, secretsDirectory); ok && secret.File != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneSecrets removes the secrets of all deployments that are no longer used, unchanged projects keep
+// running from the deployment they were started from, so the secrets of that deployment are kept too
+func (d *RuntimeActivator) pruneSecrets() error {
+	keep := map[string]bool{d.state.CurrentHash: true}
+	for _, project := range d.state.Projects {
+		keep[project.Hash] = true
+	}
+
+	entries, err := os.ReadDir(d.secretsDirectory)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Join(err, errors.New("failed to read secrets directory"))
+	}
+
+	for _, entry := range entries {
+		if keep[entry.Name()] {
+			continue
+		}
+
+		if err := os.RemoveAll(path.Join(d.secretsDirectory, entry.Name())); err != nil {
+			return errors.Join(err, errors.New("failed to remove secrets"))
+		}
+	}
+
+	return nil
+}
+
+// RemoveSecrets wipes all secrets written by the activator, it's called at shutdown
+func (d *RuntimeActivator) RemoveSecrets() error {
+	err := os.RemoveAll(d.secretsDirectory)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to remove secrets"))
+	}
+
+	return nil
+}
+
+// mountSecrets changes the bind mounts of the project to mount secrets from the secrets directory. The
+// secrets in the deployment directory are symlinks, which can't be resolved inside a container when the
+// directory containing them is mounted. So mounted directories containing secrets are copied next to the
+// secrets, and mounted from there
+func (d *RuntimeActivator) mountSecrets(project *types.Project, hash string) error {
+	for i, service := range project.Services {
+		service, err := d.mountServiceSecrets(service, hash)
+		if err != nil {
+			return err
+		}
+
+		project.Services[i] = service
+	}
+
+	directory, secretsDirectory, err := d.absDirectories(hash)
+	if err != nil {
+		return err
+	}
+
+	// configs and secrets are single files, so only their source is changed
+	for name, config := range project.Configs {
+		if relName, ok := secretLink(config.File, directory); ok {
+			config.File = path.Join(secretsDirectory, relName)
+			project.Configs[name] = config
+		}
+	}
+
+	for name, secret := range project.Secrets {
+		if relName, ok := secretLink(secret.File, directory); ok {
+			secret.File = path.Join(secretsDirectory, relName)
+			project.Secrets[name] = secret
+		}
+	}
+
+	return nil
+}
+
+// mountServiceSecrets returns the service with the bind mounts containing secrets mounted from the secrets directory
+func (d *RuntimeActivator) mountServiceSecrets(service types.ServiceConfig, hash string) (types.ServiceConfig, error) {
+	directory, secretsDirectory, err := d.absDirectories(hash)
+	if err != nil {
+		return service, err
+	}
+
+	service.Volumes = slices.Clone(service.Volumes)
+	for i, volume := range service.Volumes {
+		if volume.Type != types.VolumeTypeBind {
+			continue
+		}
+
+		source, err := mountSecret(volume.Source, directory, secretsDirectory)
+		if err != nil {
+			return service, errors.Join(err, fmt.Errorf("failed to mount secrets of service '%s'", service.Name))
+		}
+
+		service.Volumes[i].Source = source
+	}
+
+	return service, nil
+}
+
+// absDirectories returns the absolute deployment and secrets directories of a commit
+func (d *RuntimeActivator) absDirectories(hash string) (string, string, error) {
+	directory, err := filepath.Abs(path.Join(d.deploymentDirectory, hash))
+	if err != nil {
+		return "", "", errors.Join(err, errors.New("invalid deployment directory"))
+	}
+
+	secretsDirectory, err := filepath.Abs(path.Join(d.secretsDirectory, hash))
+	if err != nil {
+		return "", "", errors.Join(err, errors.New("invalid secrets directory"))
+	}
+
+	return directory, secretsDirectory, nil
+}
+
+// mountSecret returns the source to mount instead of a file in the deployment directory. A secret is mounted
+// from the secrets directory, and a directory containing secrets is copied to the secrets directory first
+func mountSecret(source string, directory string, secretsDirectory string) (string, error) {
+	relSource, ok := relativeTo(source, directory)
+	if !ok {
+		return source, nil
+	}
+
+	if _, ok := secretLink(source, directory); ok {
+		return path.Join(secretsDirectory, relSource), nil
+	}
+
+	// secrets are written to the same path in the secrets directory, so only the other files are copied
+	secretSource := path.Join(secretsDirectory, relSource)
+	found := false
+	err := filepath.WalkDir(source, func(fileName string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && fileName == source {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Type()&fs.ModeSymlink != 0 {
+			found = true
+		}
+
+		return nil
+	})
+	if err != nil || !found {
+		return source, err
+	}
+
+	err = filepath.WalkDir(source, func(fileName string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.Type()&fs.ModeSymlink != 0 {
+			return err
+		}
+
+		relName, err := filepath.Rel(source, fileName)
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		target := path.Join(secretSource, filepath.ToSlash(relName))
+		if entry.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(target, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		// the file might already exist from an earlier attempt, so make sure the mode is updated
+		return os.Chmod(target, info.Mode().Perm())
+	})
+	if err != nil {
+		return source, errors.Join(err, fmt.Errorf("failed to copy '%s' to the secrets directory", relSource))
+	}
+
+	return secretSource, nil
+}
+
+// secretLink returns the path relative to the deployment directory, if the file is a secret in it
+func secretLink(fileName string, directory string) (string, bool) {
+	relName, ok := relativeTo(fileName, directory)
+	if !ok {
+		return "", false
+	}
+
+	info, err := os.Lstat(fileName)
+	return relName, err == nil && info.Mode()&fs.ModeSymlink != 0
+}
+
+// relativeTo returns the path of the file relative to the directory, if it's inside the directory
+func relativeTo(fileName string, directory string) (string, bool) {
+	absName, err := filepath.Abs(fileName)
+	if err != nil {
+		return "", false
+	}
+
+	relName, err := filepath.Rel(directory, absName)
+	if err != nil || relName == ".." || strings.HasPrefix(relName, "../") {
+		return "", false
+	}
+
+	return filepath.ToSlash(relName), true
+}
@@ -0,0 +1,199 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/exp/slog"
+)
+
+// errCorruptCache is joined to errors caused by the local repository, rather than the remote. Only these
+// errors clear the cache, so a network outage doesn't cause a full clone
+var errCorruptCache = errors.New("repository cache is corrupt")
+
+// getGitRepo fetches the configured branch, tag or commit, checks it out, and returns the
+// ref that was fetched. When a cache directory is configured the repository is kept on disk,
+// and only the changes since the last sync are fetched
+func (g *GitOps) getGitRepo() (*git.Repository, string, error) {
+	auth, err := g.getAuth()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if g.repo.CacheDirectory == "" {
+		return g.fetchRepo(memory.NewStorage(), memfs.New(), auth)
+	}
+
+	repo, refName, err := g.fetchRepo(g.getCacheStorage(), osfs.New(g.cacheWorktreeDirectory()), auth)
+	if err == nil || !errors.Is(err, errCorruptCache) {
+		return repo, refName, err
+	}
+
+	// the cache is corrupt, so start over with a fresh clone
+	slog.Warn("failed to update repository cache, cloning again", slog.String("directory", g.repo.CacheDirectory), slog.String("error", err.Error()))
+	if err := os.RemoveAll(g.repo.CacheDirectory); err != nil {
+		return nil, "", errors.Join(err, errors.New("failed to remove repository cache"))
+	}
+
+	return g.fetchRepo(g.getCacheStorage(), osfs.New(g.cacheWorktreeDirectory()), auth)
+}
+
+func (g *GitOps) fetchRepo(storer storage.Storer, worktree billy.Filesystem, auth transport.AuthMethod) (*git.Repository, string, error) {
+	repo, err := git.Open(storer, worktree)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.Init(storer, worktree)
+	}
+	if err != nil {
+		return nil, "", errors.Join(errCorruptCache, err, errors.New("failed to open repository"))
+	}
+
+	remote, err := g.getOriginRemote(repo)
+	if err != nil {
+		return nil, "", errors.Join(errCorruptCache, err)
+	}
+
+	refName := g.repo.Branch
+	localRef := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, g.repo.Branch)
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(g.repo.Branch), localRef))
+	switch {
+	case g.repo.Commit != "":
+		refName = g.repo.Commit
+		localRef = plumbing.NewBranchReferenceName("gear")
+		refSpec = config.RefSpec(fmt.Sprintf("%s:%s", g.repo.Commit, localRef))
+	case g.repo.Tag != "":
+		refName, _, err = g.getGitRemoteHead()
+		if err != nil {
+			return nil, "", err
+		}
+
+		localRef = plumbing.NewTagReferenceName(refName)
+		refSpec = config.RefSpec(fmt.Sprintf("+%s:%s", localRef, localRef))
+	}
+
+	// the history is needed to check a tag wasn't moved to an older commit
+	depth := 1
+	if g.checksAncestry() {
+		depth = 0
+	}
+
+	err = remote.Fetch(&git.FetchOptions{
+		RefSpecs: []config.RefSpec{refSpec},
+		Auth:     auth,
+		Depth:    depth,
+		Tags:     git.NoTags,
+		Force:    true,
+	})
+	if errors.Is(err, git.ErrExactSHA1NotSupported) {
+		// the server doesn't allow fetching commits by hash, so fetch all branches instead
+		err = remote.Fetch(&git.FetchOptions{
+			RefSpecs: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+			Auth:     auth,
+			Tags:     git.NoTags,
+		})
+	}
+	// objects missing from the local storage means the cache is broken, other errors are from the remote
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		err = errors.Join(errCorruptCache, err)
+	}
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, "", errors.Join(err, errors.New("failed to fetch"))
+	}
+
+	commit, err := g.getFetchedCommit(repo, localRef)
+	if err != nil {
+		return nil, "", errors.Join(errCorruptCache, err)
+	}
+
+	if err := g.verifyAncestry(commit); err != nil {
+		return nil, "", err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, "", errors.Join(errCorruptCache, err, errors.New("failed to get worktree"))
+	}
+
+	err = wt.Checkout(&git.CheckoutOptions{Hash: commit.Hash, Force: true})
+	if err != nil {
+		return nil, "", errors.Join(errCorruptCache, err, errors.New("failed to checkout"))
+	}
+
+	return repo, refName, nil
+}
+
+func (g *GitOps) getOriginRemote(repo *git.Repository) (*git.Remote, error) {
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err == nil && remote.Config().URLs[0] == g.repo.Url {
+		return remote, nil
+	}
+
+	// the url changed since the repository was cached
+	if err == nil {
+		if err := repo.DeleteRemote(git.DefaultRemoteName); err != nil {
+			return nil, errors.Join(err, errors.New("failed to remove remote"))
+		}
+	}
+
+	remote, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{g.repo.Url},
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to create remote"))
+	}
+
+	return remote, nil
+}
+
+func (g *GitOps) getFetchedCommit(repo *git.Repository, localRef plumbing.ReferenceName) (*object.Commit, error) {
+	hash := plumbing.NewHash(g.repo.Commit)
+	if g.repo.Commit == "" {
+		ref, err := repo.Reference(localRef, true)
+		if err != nil {
+			return nil, errors.Join(err, fmt.Errorf("failed to get fetched ref '%s'", localRef))
+		}
+		hash = ref.Hash()
+	}
+
+	commit, err := repo.CommitObject(hash)
+	if errors.Is(err, plumbing.ErrObjectNotFound) || errors.Is(err, plumbing.ErrInvalidType) {
+		// annotated tags point to a tag object, get the commit it's tagging
+		commit, err = getTaggedCommit(repo, hash)
+	}
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to get fetched commit"))
+	}
+
+	return commit, nil
+}
+
+func getTaggedCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	tag, err := repo.TagObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return tag.Commit()
+}
+
+func (g *GitOps) getCacheStorage() storage.Storer {
+	return filesystem.NewStorage(osfs.New(filepath.Join(g.repo.CacheDirectory, "git")), cache.NewObjectLRUDefault())
+}
+
+func (g *GitOps) cacheWorktreeDirectory() string {
+	return filepath.Join(g.repo.CacheDirectory, "worktree")
+}
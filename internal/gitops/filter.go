@@ -0,0 +1,94 @@
+package gitops
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// gearIgnoreFile can be placed in the root of the repository, to exclude files from the bundle
+const gearIgnoreFile = ".gearignore"
+
+// fileFilter decides which files in the repository are part of the bundle, using
+// gitignore style patterns. If no include patterns are set, all files are included
+type fileFilter struct {
+	include gitignore.Matcher
+	exclude gitignore.Matcher
+}
+
+func (g *GitOps) getFileFilter(fs billy.Filesystem) (*fileFilter, error) {
+	ignorePatterns, err := readGearIgnore(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	// patterns from the config are added last, so they take precedence over the repository
+	filter := &fileFilter{
+		exclude: gitignore.NewMatcher(append(ignorePatterns, parsePatterns(g.repo.Exclude)...)),
+	}
+
+	if len(g.repo.Include) > 0 {
+		filter.include = gitignore.NewMatcher(parsePatterns(g.repo.Include))
+	}
+
+	return filter, nil
+}
+
+func (f *fileFilter) isIncluded(fileName string) bool {
+	if fileName == gearIgnoreFile || fileName == manifestFileName {
+		return false
+	}
+
+	parts := strings.Split(fileName, "/")
+
+	// like git, a file can't be included again if any of its parent directories are excluded
+	for i := 1; i < len(parts); i++ {
+		if f.exclude.Match(parts[:i], true) {
+			return false
+		}
+	}
+
+	if f.exclude.Match(parts, false) {
+		return false
+	}
+
+	return f.include == nil || f.include.Match(parts, false)
+}
+
+func readGearIgnore(fs billy.Filesystem) ([]gitignore.Pattern, error) {
+	data, err := util.ReadFile(fs, gearIgnoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read "+gearIgnoreFile))
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return parsePatterns(lines), nil
+}
+
+func parsePatterns(lines []string) []gitignore.Pattern {
+	var patterns []gitignore.Pattern
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, gitignore.ParsePattern(line, nil))
+	}
+
+	return patterns
+}
@@ -0,0 +1,69 @@
+package gitops
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Host describes the host gear is running on, it's used to select the projects and overrides to deploy,
+// and together with the variables it's available to templates in the bundle
+type Host struct {
+	Identifier string
+	Labels     map[string]string
+	Variables  map[string]string
+
+	// the label keys in the order their overrides are layered, labels missing from it are layered after, by key
+	LabelOrder []string
+}
+
+// matchesSelector returns true if the host has all the labels in the selector, an empty selector matches all hosts
+func (h Host) matchesSelector(selector map[string]string) bool {
+	for key, value := range selector {
+		if label, ok := h.Labels[key]; !ok || label != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesCustomisation returns true if the customise directory applies to the host, the
+// directory is either the host identifier, or a label in the form <key>=<value>
+func (h Host) matchesCustomisation(directory string) bool {
+	if key, value, ok := strings.Cut(directory, "="); ok {
+		return h.matchesSelector(map[string]string{key: value})
+	}
+
+	return h.Identifier != "" && directory == h.Identifier
+}
+
+// customisationLayer returns the position of a matching customise directory in the layering, the label
+// overrides are layered in the order of the labels, and the override for the host identifier is layered last
+func (h Host) customisationLayer(directory string) int {
+	order := h.labelOrder()
+	if key, _, ok := strings.Cut(directory, "="); ok {
+		return slices.Index(order, key)
+	}
+
+	return len(order)
+}
+
+// labelOrder returns the keys of all labels, in the label order followed by the labels missing from it
+func (h Host) labelOrder() []string {
+	var order, missing []string
+	for _, key := range h.LabelOrder {
+		if _, ok := h.Labels[key]; ok && !slices.Contains(order, key) {
+			order = append(order, key)
+		}
+	}
+
+	for key := range h.Labels {
+		if !slices.Contains(order, key) {
+			missing = append(missing, key)
+		}
+	}
+
+	sort.Strings(missing)
+	return append(order, missing...)
+}
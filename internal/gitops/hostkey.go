@@ -0,0 +1,95 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/exp/slog"
+)
+
+// getHostKeyCallback returns a callback verifying the ssh host key against the pinned
+// fingerprints and the known hosts file. If neither is configured nil is returned,
+// and the default go-git verification is used
+func (g *GitOps) getHostKeyCallback() (ssh.HostKeyCallback, error) {
+	if len(g.repo.HostKeyFingerprints) == 0 && g.repo.KnownHostsFile == "" {
+		return nil, nil
+	}
+
+	var knownHostsCallback ssh.HostKeyCallback
+	if g.repo.KnownHostsFile != "" {
+		if g.repo.TrustOnFirstUse {
+			// make sure the file exists, so there's something to learn keys into
+			file, err := os.OpenFile(g.repo.KnownHostsFile, os.O_CREATE|os.O_RDONLY, 0600)
+			if err != nil {
+				return nil, errors.Join(err, errors.New("failed to create known hosts file"))
+			}
+			file.Close()
+		}
+
+		callback, err := knownhosts.New(g.repo.KnownHostsFile)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to load known hosts file"))
+		}
+		knownHostsCallback = callback
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(g.repo.HostKeyFingerprints) > 0 && !slices.Contains(g.repo.HostKeyFingerprints, fingerprint) {
+			return fmt.Errorf("ssh host key verification failed for '%s', fingerprint %s is not pinned", hostname, fingerprint)
+		}
+
+		if knownHostsCallback == nil {
+			return nil
+		}
+
+		err := knownHostsCallback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 && g.repo.TrustOnFirstUse {
+			return g.trustHostKey(hostname, remote, key)
+		}
+
+		if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+			return fmt.Errorf("ssh host key verification failed for '%s', fingerprint %s does not match the known hosts file", hostname, fingerprint)
+		}
+
+		if err != nil {
+			return errors.Join(err, fmt.Errorf("ssh host key verification failed for '%s'", hostname))
+		}
+
+		return nil
+	}, nil
+}
+
+// trustHostKey adds a host key to the known hosts file, this is only done for hosts
+// not already in the file, after that the key is verified like any other known host
+func (g *GitOps) trustHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	slog.Warn(
+		"trusting ssh host key on first use",
+		slog.String("host", hostname),
+		slog.String("fingerprint", ssh.FingerprintSHA256(key)),
+		slog.String("file", g.repo.KnownHostsFile),
+	)
+
+	file, err := os.OpenFile(g.repo.KnownHostsFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to open known hosts file"))
+	}
+	defer file.Close()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && remote.String() != hostname {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+
+	if _, err := file.WriteString(knownhosts.Line(addresses, key) + "\n"); err != nil {
+		return errors.Join(err, errors.New("failed to write known hosts file"))
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"gopkg.in/yaml.v3"
+)
+
+// manifestFileName can be placed in the root of the repository, to describe the projects
+// to deploy instead of using the repository layout
+const manifestFileName = "gear.yaml"
+
+var validProjectName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+type manifest struct {
+	Projects []manifestProject `yaml:"projects"`
+}
+
+type manifestProject struct {
+	Name           string              `yaml:"name"`
+	Files          []string            `yaml:"files"`
+	LabelOverrides []manifestOverride  `yaml:"label_overrides"`
+	Overrides      map[string][]string `yaml:"overrides"`
+	EnvFiles       []string            `yaml:"env_files"`
+	Hosts          []string            `yaml:"hosts"`
+	Selector       map[string]string   `yaml:"selector"`
+}
+
+// manifestOverride are compose files added for hosts with all the labels in the selector
+type manifestOverride struct {
+	Selector map[string]string `yaml:"selector"`
+	Files    []string          `yaml:"files"`
+}
+
+// BundleProject is a compose project to deploy, the files are relative to the bundle root
+type BundleProject struct {
+	Name     string
+	Files    []string
+	EnvFiles []string
+}
+
+// readManifest reads the manifest from the root of the filesystem, nil is returned if there's no manifest
+func readManifest(fs billy.Filesystem) (*manifest, error) {
+	data, err := util.ReadFile(fs, manifestFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read manifest"))
+	}
+
+	var m manifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Join(err, errors.New("invalid manifest"))
+	}
+
+	names := make(map[string]bool)
+	for _, project := range m.Projects {
+		if !validProjectName.MatchString(project.Name) {
+			return nil, fmt.Errorf("invalid manifest, invalid project name '%s'", project.Name)
+		}
+
+		if names[project.Name] {
+			return nil, fmt.Errorf("invalid manifest, duplicate project name '%s'", project.Name)
+		}
+		names[project.Name] = true
+
+		if len(project.Files) == 0 {
+			return nil, fmt.Errorf("invalid manifest, project '%s' has no files", project.Name)
+		}
+
+		for _, override := range project.LabelOverrides {
+			if len(override.Selector) == 0 {
+				return nil, fmt.Errorf("invalid manifest, label override of project '%s' has no selector", project.Name)
+			}
+		}
+	}
+
+	return &m, nil
+}
+
+// getProjects returns the projects in the manifest targeting this host, in the order they are listed.
+// The overrides are layered on top of the project files, first the label overrides matching the host
+// in the order they are listed, then the overrides for the host identifier. All files must be part of the bundle
+func (m *manifest) getProjects(host Host, files []BundleFile) ([]BundleProject, error) {
+	var projects []BundleProject
+	for _, project := range m.Projects {
+		if len(project.Hosts) > 0 && !slices.Contains(project.Hosts, host.Identifier) {
+			continue
+		}
+
+		if !host.matchesSelector(project.Selector) {
+			continue
+		}
+
+		bundleProject := BundleProject{
+			Name:     project.Name,
+			Files:    cleanPaths(project.Files),
+			EnvFiles: cleanPaths(project.EnvFiles),
+		}
+
+		for _, override := range project.LabelOverrides {
+			if host.matchesSelector(override.Selector) {
+				bundleProject.Files = append(bundleProject.Files, cleanPaths(override.Files)...)
+			}
+		}
+
+		if host.Identifier != "" {
+			bundleProject.Files = append(bundleProject.Files, cleanPaths(project.Overrides[host.Identifier])...)
+		}
+
+		for _, fileName := range append(slices.Clone(bundleProject.Files), bundleProject.EnvFiles...) {
+			if !slices.ContainsFunc(files, func(f BundleFile) bool { return f.FileName == fileName }) {
+				return nil, fmt.Errorf("invalid manifest, file '%s' of project '%s' is not in the bundle", fileName, project.Name)
+			}
+		}
+
+		projects = append(projects, bundleProject)
+	}
+
+	// an empty list means there's nothing to deploy on this host, which is different from no manifest
+	if projects == nil {
+		projects = []BundleProject{}
+	}
+
+	return projects, nil
+}
+
+// cleanPaths makes the paths relative to the bundle root
+func cleanPaths(paths []string) []string {
+	var cleaned []string
+	for _, p := range paths {
+		cleaned = append(cleaned, path.Clean("/" + p)[1:])
+	}
+
+	return cleaned
+}
@@ -0,0 +1,62 @@
+package gitops
+
+import (
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// MatchesPush returns true if a push to the ref of one of the repository urls can change what is deployed.
+// A push without urls or without a ref can't be filtered, so it matches all repositories
+func (g *GitOps) MatchesPush(urls []string, ref string) bool {
+	if len(urls) > 0 {
+		matched := false
+		for _, url := range urls {
+			if repositoryPath(url) == repositoryPath(g.repo.Url) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	switch {
+	case ref == "":
+		return true
+	case g.repo.Commit != "":
+		// a pinned commit doesn't change with a push
+		return false
+	case g.repo.Tag != "":
+		name, ok := strings.CutPrefix(ref, "refs/tags/")
+		return ok && matchTag(g.repo.Tag, name)
+	default:
+		return ref == plumbing.NewBranchReferenceName(g.repo.Branch).String()
+	}
+}
+
+// repositoryPath returns the host and path of a repository url, without the scheme, user, port and .git suffix.
+// So the http and ssh urls of a repository, like https://host/org/repo and git@host:org/repo.git, are the same
+func repositoryPath(url string) string {
+	url = strings.ToLower(strings.TrimSpace(url))
+	if _, rest, ok := strings.Cut(url, "://"); ok {
+		url = rest
+	} else if host, repoPath, ok := strings.Cut(url, ":"); ok && !strings.Contains(host, "/") {
+		// scp like ssh urls, host:path
+		url = host + "/" + repoPath
+	}
+
+	host, repoPath, _ := strings.Cut(url, "/")
+	if _, after, ok := strings.Cut(host, "@"); ok {
+		host = after
+	}
+
+	if name, _, ok := strings.Cut(host, ":"); ok {
+		host = name
+	}
+
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+	return host + "/" + strings.Trim(repoPath, "/")
+}
@@ -0,0 +1,32 @@
+package gitops
+
+import "testing"
+
+func TestMatchesPush(t *testing.T) {
+	urls := []string{"https://github.com/example/deployments.git", "git@github.com:example/deployments.git"}
+	tests := []struct {
+		name       string
+		repository Repository
+		urls       []string
+		ref        string
+		expected   bool
+	}{
+		{"branch", Repository{Url: "https://github.com/example/deployments", Branch: "main"}, urls, "refs/heads/main", true},
+		{"ssh url", Repository{Url: "ssh://git@github.com:22/Example/deployments.git", Branch: "main"}, urls, "refs/heads/main", true},
+		{"other branch", Repository{Url: "https://github.com/example/deployments", Branch: "main"}, urls, "refs/heads/develop", false},
+		{"other repository", Repository{Url: "https://github.com/example/other", Branch: "main"}, urls, "refs/heads/main", false},
+		{"tag", Repository{Url: "https://github.com/example/deployments", Tag: "v1.*"}, urls, "refs/tags/v1.2.0", true},
+		{"other tag", Repository{Url: "https://github.com/example/deployments", Tag: "v1.*"}, urls, "refs/tags/v2.0.0", false},
+		{"branch for tag", Repository{Url: "https://github.com/example/deployments", Tag: "v1.*"}, urls, "refs/heads/v1.2.0", false},
+		{"commit", Repository{Url: "https://github.com/example/deployments", Commit: "0123456789abcdef"}, urls, "refs/heads/main", false},
+		{"without urls", Repository{Url: "https://github.com/example/other", Branch: "main"}, nil, "refs/heads/main", true},
+		{"without ref", Repository{Url: "https://github.com/example/deployments", Branch: "main"}, urls, "", true},
+	}
+
+	for _, test := range tests {
+		g := NewGitSync(Host{}, SyncState{}, nil, nil, test.repository)
+		if matched := g.MatchesPush(test.urls, test.ref); matched != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, matched)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// ErrRefNotFound is returned when the configured branch or tag doesn't exist on the remote
+var ErrRefNotFound = errors.New("ref not found on remote")
+
+// ErrDowngrade is returned when a tag points to a commit that doesn't contain the deployed commit, like
+// when a tag is moved to an older commit. It's not deployed unless downgrades are allowed
+var ErrDowngrade = errors.New("tag doesn't point to a newer commit than the deployed commit")
+
+// peeledSuffix is appended to annotated tag names, when listing the commit they point to
+const peeledSuffix = "^{}"
+
+// resolveTag returns the newest tag matching the selector, and the commit it points to.
+// The selector is either a semver constraint like "~1.4", or a glob like "prod-*"
+func resolveTag(selector string, refs []*plumbing.Reference) (string, plumbing.Hash, error) {
+	tags := make(map[string]plumbing.Hash)
+	for _, ref := range refs {
+		if !ref.Name().IsTag() {
+			continue
+		}
+
+		// annotated tags are listed twice, prefer the commit over the tag object
+		name, peeled := strings.CutSuffix(ref.Name().Short(), peeledSuffix)
+		if _, ok := tags[name]; ok && !peeled {
+			continue
+		}
+
+		tags[name] = ref.Hash()
+	}
+
+	var matching []string
+	for name := range tags {
+		if matchTag(selector, name) {
+			matching = append(matching, name)
+		}
+	}
+
+	if len(matching) == 0 {
+		return "", plumbing.ZeroHash, errors.Join(ErrRefNotFound, fmt.Errorf("no tag matching '%s' found", selector))
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return compareTags(selector, matching[i], matching[j]) < 0
+	})
+
+	newest := matching[len(matching)-1]
+	return newest, tags[newest], nil
+}
+
+func matchTag(selector string, name string) bool {
+	if constraint, err := semver.NewConstraint(selector); err == nil {
+		version, err := semver.NewVersion(name)
+		return err == nil && constraint.Check(version)
+	}
+
+	matched, err := path.Match(selector, name)
+	return err == nil && matched
+}
+
+// compareTags orders tags by semver when the selector is a semver constraint,
+// otherwise tags are ordered by comparing the numbers in them, like "sort -V"
+func compareTags(selector string, a string, b string) int {
+	if _, err := semver.NewConstraint(selector); err == nil {
+		versionA, errA := semver.NewVersion(a)
+		versionB, errB := semver.NewVersion(b)
+		if errA == nil && errB == nil {
+			return versionA.Compare(versionB)
+		}
+	}
+
+	return compareVersionStrings(a, b)
+}
+
+func compareVersionStrings(a string, b string) int {
+	partsA, partsB := splitVersionString(a), splitVersionString(b)
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		numA, errA := strconv.ParseUint(partsA[i], 10, 64)
+		numB, errB := strconv.ParseUint(partsB[i], 10, 64)
+		if errA == nil && errB == nil {
+			if numA != numB {
+				if numA < numB {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+
+		if c := strings.Compare(partsA[i], partsB[i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(partsA) - len(partsB)
+}
+
+// splitVersionString splits a string into alternating runs of digits and non digits
+func splitVersionString(s string) []string {
+	var parts []string
+	for len(s) > 0 {
+		isDigit := unicode.IsDigit(rune(s[0]))
+		end := strings.IndexFunc(s, func(r rune) bool {
+			return unicode.IsDigit(r) != isDigit
+		})
+		if end == -1 {
+			end = len(s)
+		}
+
+		parts = append(parts, s[:end])
+		s = s[end:]
+	}
+
+	return parts
+}
+
+// checksAncestry returns true if a tag must point to a commit containing the deployed commit
+func (g *GitOps) checksAncestry() bool {
+	return g.repo.Tag != "" && !g.repo.AllowDowngrade && g.currentHash != ""
+}
+
+// verifyAncestry returns ErrDowngrade if the deployed commit isn't in the history of the commit, so a tag
+// moved to an older commit isn't deployed. The history of a cached repository fetched by an older version
+// might be shallow, then the cache is cleared so the full history is fetched
+func (g *GitOps) verifyAncestry(commit *object.Commit) error {
+	if !g.checksAncestry() || commit.Hash.String() == g.currentHash {
+		return nil
+	}
+
+	found := false
+	err := object.NewCommitPreorderIter(commit, nil, nil).ForEach(func(c *object.Commit) error {
+		if c.Hash.String() == g.currentHash {
+			found = true
+			return storer.ErrStop
+		}
+
+		return nil
+	})
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return errors.Join(errCorruptCache, err, errors.New("history of the commit is incomplete"))
+	}
+	if err != nil {
+		return errors.Join(err, errors.New("failed to read history of the commit"))
+	}
+
+	if !found {
+		return errors.Join(ErrDowngrade, fmt.Errorf("commit '%s' doesn't contain the deployed commit '%s'", commit.Hash, g.currentHash))
+	}
+
+	return nil
+}
@@ -0,0 +1,361 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretReference matches references to external secrets, like ${secret:vault/app/db#password}
+var secretReference = regexp.MustCompile(`\$\{secret:([a-z0-9_-]+)/([^#}]+)#([^}]+)\}`)
+
+const secretResolveTimeout = time.Minute
+
+// resolveFunc returns the value of a secret reference
+type resolveFunc func(reference string) (string, error)
+
+// escapeFunc escapes a secret value, for where the reference is in the file
+type escapeFunc func(value string) (string, error)
+
+// resolveSecretReferences replaces references to external secrets in compose and env files with
+// their values, files containing references are marked as secrets so they are not persisted to disk.
+// The values are quoted and escaped for the file they are inserted in, so they are read as they are
+func (g *GitOps) resolveSecretReferences(files []BundleFile) ([]BundleFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretResolveTimeout)
+	defer cancel()
+
+	resolved := make(map[string]string)
+	for i, file := range files {
+		if !isSecretReferenceFile(file.FileName) || !secretReference.Match(file.Data) {
+			continue
+		}
+
+		resolve := func(reference string) (string, error) {
+			if value, ok := resolved[reference]; ok {
+				return value, nil
+			}
+
+			match := secretReference.FindStringSubmatch(reference)
+			providerName, secretPath, key := match[1], match[2], match[3]
+			provider, ok := g.secretProviders[providerName]
+			if !ok {
+				return "", fmt.Errorf("unknown secret provider '%s'", providerName)
+			}
+
+			value, err := provider.GetSecret(ctx, secretPath, key)
+			if err != nil {
+				return "", errors.Join(err, fmt.Errorf("failed to resolve secret '%s'", reference))
+			}
+
+			resolved[reference] = value
+			return value, nil
+		}
+
+		var data []byte
+		var err error
+		if path.Ext(file.FileName) == ".env" {
+			data, err = resolveEnvReferences(file.Data, resolve)
+		} else {
+			data, err = resolveYAMLReferences(file.Data, resolve)
+		}
+
+		if err != nil {
+			return nil, errors.Join(err, fmt.Errorf("failed to resolve secrets in '%s'", file.FileName))
+		}
+
+		files[i].Data = data
+		files[i].IsSecret = true
+	}
+
+	return files, nil
+}
+
+// isSecretReferenceFile returns true for the files secret references are resolved in, compose and env files
+func isSecretReferenceFile(fileName string) bool {
+	switch path.Ext(fileName) {
+	case ".yaml", ".yml", ".env":
+		return true
+	}
+
+	return false
+}
+
+// replaceReferences replaces the references in the value with the escaped secret values
+func replaceReferences(value string, resolve resolveFunc, escape escapeFunc) (string, error) {
+	var errs []error
+	value = secretReference.ReplaceAllStringFunc(value, func(reference string) string {
+		secret, err := resolve(reference)
+		if err == nil {
+			secret, err = escape(secret)
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+			return reference
+		}
+
+		return secret
+	})
+
+	return value, errors.Join(errs...)
+}
+
+// resolveYAMLReferences replaces the references in the scalars of a yaml file, the file is encoded again so
+// the values are quoted as needed, and a secret can't add keys or end a value. Compose files interpolate
+// variables, so a $ in the secrets is escaped in them
+func resolveYAMLReferences(data []byte, resolve resolveFunc) ([]byte, error) {
+	var documents []*yaml.Node
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var document yaml.Node
+		err := decoder.Decode(&document)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.Join(err, errors.New("invalid yaml file"))
+		}
+
+		documents = append(documents, &document)
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	for _, document := range documents {
+		escape := func(value string) (string, error) {
+			return value, nil
+		}
+
+		if isComposeDocument(document) {
+			escape = func(value string) (string, error) {
+				return strings.ReplaceAll(value, "$", "$$"), nil
+			}
+		}
+
+		if err := replaceNodeReferences(document, resolve, escape); err != nil {
+			return nil, err
+		}
+
+		if err := encoder.Encode(document); err != nil {
+			return nil, errors.Join(err, errors.New("failed to encode yaml file"))
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, errors.Join(err, errors.New("failed to encode yaml file"))
+	}
+
+	return out.Bytes(), nil
+}
+
+// replaceNodeReferences replaces the references in all scalars of the node, they are always strings
+func replaceNodeReferences(node *yaml.Node, resolve resolveFunc, escape escapeFunc) error {
+	if node.Kind == yaml.ScalarNode && secretReference.MatchString(node.Value) {
+		value, err := replaceReferences(node.Value, resolve, escape)
+		if err != nil {
+			return err
+		}
+
+		node.Value = value
+		node.Tag = "!!str"
+	}
+
+	for _, child := range node.Content {
+		if err := replaceNodeReferences(child, resolve, escape); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isComposeDocument returns true if the document has a top level services key
+func isComposeDocument(document *yaml.Node) bool {
+	if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return false
+	}
+
+	mapping := document.Content[0]
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == "services" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveEnvReferences replaces the references in the values of an env file. The file is read the way compose
+// reads env files, and the secrets are escaped for the quotes of the value, unquoted values with references are
+// double quoted. So a secret can't add variables or end the value. References in comments are left as is
+func resolveEnvReferences(data []byte, resolve resolveFunc) ([]byte, error) {
+	src := string(data)
+	var out strings.Builder
+	for len(src) > 0 {
+		// whitespace and comments between the variables
+		start := strings.IndexFunc(src, func(r rune) bool { return !unicode.IsSpace(r) })
+		if start == -1 {
+			out.WriteString(src)
+			break
+		}
+
+		if start > 0 || src[0] == '#' {
+			end := start
+			if src[start] == '#' {
+				end = len(src)
+				if newline := strings.IndexByte(src[start:], '\n'); newline != -1 {
+					end = start + newline
+				}
+			}
+
+			out.WriteString(src[:end])
+			src = src[end:]
+			continue
+		}
+
+		// the name of the variable, a variable without a value ends at the newline
+		separator := strings.IndexAny(src, "=:\n")
+		if separator == -1 || src[separator] == '\n' {
+			end := len(src)
+			if separator != -1 {
+				end = separator
+			}
+
+			out.WriteString(src[:end])
+			src = src[end:]
+			continue
+		}
+
+		value := strings.TrimLeftFunc(src[separator+1:], isEnvSpace)
+		out.WriteString(src[:len(src)-len(value)])
+
+		var rest string
+		var err error
+		switch {
+		case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'"):
+			rest, err = resolveQuotedEnvValue(&out, value, resolve)
+		default:
+			rest, err = resolveUnquotedEnvValue(&out, value, resolve)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		src = rest
+	}
+
+	return []byte(out.String()), nil
+}
+
+// resolveQuotedEnvValue writes the quoted value with the references replaced, and returns the rest of the file.
+// Escapes are expanded in double quoted values, single quoted values are used as they are
+func resolveQuotedEnvValue(out *strings.Builder, src string, resolve resolveFunc) (string, error) {
+	quote := src[0]
+	end := -1
+	escaped := false
+	for i := 1; i < len(src) && end == -1; i++ {
+		switch {
+		case src[i] != quote:
+			escaped = !escaped && src[i] == '\\'
+		case escaped:
+			escaped = false
+		default:
+			end = i
+		}
+	}
+
+	if end == -1 {
+		return "", errors.New("unterminated quoted value in env file")
+	}
+
+	escape := escapeDoubleQuoted
+	if quote == '\'' {
+		escape = escapeSingleQuoted
+	}
+
+	value, err := replaceReferences(src[1:end], resolve, escape)
+	if err != nil {
+		return "", err
+	}
+
+	out.WriteByte(quote)
+	out.WriteString(value)
+	out.WriteByte(quote)
+	return src[end+1:], nil
+}
+
+// resolveUnquotedEnvValue writes the unquoted value with the references replaced, and returns the rest of the
+// file. An unquoted value ends at the newline or an inline comment, values with references are double quoted
+func resolveUnquotedEnvValue(out *strings.Builder, src string, resolve resolveFunc) (string, error) {
+	line, rest := src, ""
+	if newline := strings.IndexByte(src, '\n'); newline != -1 {
+		line, rest = src[:newline], src[newline:]
+	}
+
+	value, comment := line, ""
+	if index := strings.Index(line, " #"); index != -1 {
+		value, comment = line[:index], line[index:]
+	}
+
+	trimmed := strings.TrimRightFunc(value, unicode.IsSpace)
+	comment = value[len(trimmed):] + comment
+	if !secretReference.MatchString(trimmed) {
+		out.WriteString(line)
+		return rest, nil
+	}
+
+	// the text around the references is escaped too, but variables in it are still interpolated
+	var errs []error
+	parts := secretReference.FindAllStringIndex(trimmed, -1)
+	quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	out.WriteByte('"')
+	previous := 0
+	for _, part := range parts {
+		out.WriteString(quoted.Replace(trimmed[previous:part[0]]))
+		value, err := replaceReferences(trimmed[part[0]:part[1]], resolve, escapeDoubleQuoted)
+		errs = append(errs, err)
+		out.WriteString(value)
+		previous = part[1]
+	}
+
+	out.WriteString(quoted.Replace(trimmed[previous:]))
+	out.WriteByte('"')
+	out.WriteString(comment)
+	return rest, errors.Join(errs...)
+}
+
+// escapeDoubleQuoted escapes a value for a double quoted env value, so it isn't interpolated
+func escapeDoubleQuoted(value string) (string, error) {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`).Replace(value), nil
+}
+
+// escapeSingleQuoted checks a value can be used in a single quoted env value, where nothing can be escaped
+func escapeSingleQuoted(value string) (string, error) {
+	if strings.Contains(value, "'") || strings.HasSuffix(value, `\`) {
+		return "", errors.New("secret can't be used in a single quoted value, as it contains a quote or ends with a backslash")
+	}
+
+	return value, nil
+}
+
+// isEnvSpace returns true for the whitespace compose skips before a value, which doesn't include newlines
+func isEnvSpace(r rune) bool {
+	switch r {
+	case '\t', '\v', '\f', '\r', ' ', 0x85, 0xA0:
+		return true
+	}
+
+	return false
+}
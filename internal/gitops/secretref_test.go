@@ -0,0 +1,168 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/compose-spec/compose-go/dotenv"
+	"github.com/compose-spec/compose-go/loader"
+	"github.com/compose-spec/compose-go/types"
+	"github.com/patrickfnielsen/gear/internal/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// testProvider returns the secrets by their key
+type testProvider map[string]string
+
+func (p testProvider) GetSecret(ctx context.Context, path string, key string) (string, error) {
+	value, ok := p[key]
+	if !ok {
+		return "", secrets.ErrSecretNotFound
+	}
+
+	return value, nil
+}
+
+var testSecrets = testProvider{
+	"newline": "first\nINJECTED=1",
+	"yaml":    "value\ninjected: true",
+	"comment": "pass #word",
+	"quotes":  `it's a "quote"`,
+	"dollar":  "pa$$word ${HOME}",
+	"colon":   "key: value",
+	"slash":   `back\slash\`,
+}
+
+func resolveTestFile(t *testing.T, fileName string, data string) []byte {
+	t.Helper()
+	g := NewGitSync(Host{}, SyncState{}, nil, map[string]secrets.Provider{"test": testSecrets}, Repository{})
+	files, err := g.resolveSecretReferences([]BundleFile{{FileName: fileName, Data: []byte(data)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !files[0].IsSecret {
+		t.Fatalf("expected %s to be a secret", fileName)
+	}
+
+	return files[0].Data
+}
+
+func TestResolveSecretReferencesEscapesEnvValues(t *testing.T) {
+	data := resolveTestFile(t, "app.env", `# ${secret:test/app#missing}
+NEWLINE=${secret:test/app#newline}
+COMMENT=${secret:test/app#comment} # inline comment
+QUOTES="${secret:test/app#quotes}"
+DOLLAR=prefix-${secret:test/app#dollar}
+SINGLE='${secret:test/app#colon}'
+SLASH="${secret:test/app#slash}"
+YAML: ${secret:test/app#yaml}
+PLAIN=$$HOME
+`)
+
+	values, err := dotenv.UnmarshalBytesWithLookup(data, func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatalf("invalid env file: %v\n%s", err, data)
+	}
+
+	expected := map[string]string{
+		"NEWLINE": testSecrets["newline"],
+		"COMMENT": testSecrets["comment"],
+		"QUOTES":  testSecrets["quotes"],
+		"DOLLAR":  "prefix-" + testSecrets["dollar"],
+		"SINGLE":  testSecrets["colon"],
+		"SLASH":   testSecrets["slash"],
+		"YAML":    testSecrets["yaml"],
+		"PLAIN":   "$HOME",
+	}
+
+	if len(values) != len(expected) {
+		t.Fatalf("expected %d variables, got %v\n%s", len(expected), values, data)
+	}
+
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, values[key])
+		}
+	}
+}
+
+func TestResolveSecretReferencesRejectsQuoteInSingleQuotedEnvValue(t *testing.T) {
+	g := NewGitSync(Host{}, SyncState{}, nil, map[string]secrets.Provider{"test": testSecrets}, Repository{})
+	_, err := g.resolveSecretReferences([]BundleFile{{FileName: "app.env", Data: []byte("QUOTES='${secret:test/app#quotes}'\n")}})
+	if err == nil {
+		t.Fatal("expected error for a quote in a single quoted value")
+	}
+}
+
+func TestResolveSecretReferencesEscapesYAMLValues(t *testing.T) {
+	data := resolveTestFile(t, "config.yaml", `database:
+  password: ${secret:test/app#yaml}
+  user: "${secret:test/app#quotes}"
+  url: postgres://${secret:test/app#colon}@db # comment
+---
+list:
+  - ${secret:test/app#newline}
+`)
+
+	var config struct {
+		Database map[string]string `yaml:"database"`
+	}
+	var list struct {
+		List []string `yaml:"list"`
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&config); err != nil {
+		t.Fatalf("invalid yaml file: %v\n%s", err, data)
+	}
+	if err := decoder.Decode(&list); err != nil {
+		t.Fatalf("invalid yaml file: %v\n%s", err, data)
+	}
+
+	expected := map[string]string{
+		"password": testSecrets["yaml"],
+		"user":     testSecrets["quotes"],
+		"url":      "postgres://" + testSecrets["colon"] + "@db",
+	}
+
+	if len(config.Database) != len(expected) {
+		t.Fatalf("expected %d keys, got %v\n%s", len(expected), config.Database, data)
+	}
+
+	for key, value := range expected {
+		if config.Database[key] != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, config.Database[key])
+		}
+	}
+
+	if len(list.List) != 1 || list.List[0] != testSecrets["newline"] {
+		t.Errorf("expected list with %q, got %v", testSecrets["newline"], list.List)
+	}
+}
+
+func TestResolveSecretReferencesEscapesInterpolationInComposeFiles(t *testing.T) {
+	data := resolveTestFile(t, "compose.yaml", `services:
+  web:
+    image: nginx
+    environment:
+      PASSWORD: ${secret:test/app#dollar}
+`)
+
+	project, err := loader.Load(types.ConfigDetails{
+		WorkingDir:  t.TempDir(),
+		ConfigFiles: []types.ConfigFile{{Filename: "compose.yaml", Content: data}},
+		Environment: map[string]string{"HOME": "/root"},
+	}, func(options *loader.Options) {
+		options.SetProjectName("test", true)
+	})
+	if err != nil {
+		t.Fatalf("invalid compose file: %v\n%s", err, data)
+	}
+
+	password := project.Services[0].Environment["PASSWORD"]
+	if password == nil || *password != testSecrets["dollar"] {
+		t.Errorf("expected the secret to not be interpolated, got %v", password)
+	}
+}
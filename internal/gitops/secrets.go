@@ -2,23 +2,137 @@ package gitops
 
 import (
 	"bytes"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strings"
 
 	"filippo.io/age"
 	"filippo.io/age/agessh"
 )
 
-func decryptSecret(decryptionKey []byte, fileName string, data []byte) ([]byte, error) {
-	ident, err := agessh.ParseIdentity(decryptionKey)
+// ParseIdentities parses an identity file with one or more age identities, either native
+// X25519 identities (AGE-SECRET-KEY-1...) one per line, or PEM encoded SSH private keys
+func ParseIdentities(data []byte) ([]age.Identity, error) {
+	var identities []age.Identity
+	rest := data
+	for len(rest) > 0 {
+		// ssh keys span multiple lines, so they are parsed as pem blocks
+		if start := bytes.Index(rest, []byte("-----BEGIN ")); start != -1 {
+			x25519Identities, err := parseX25519Identities(rest[:start])
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, x25519Identities...)
+
+			block, remaining := pem.Decode(rest[start:])
+			if block == nil {
+				return nil, errors.New("invalid ssh private key in identity file")
+			}
+
+			identity, err := agessh.ParseIdentity(pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, errors.Join(err, errors.New("failed to parse ssh identity"))
+			}
+
+			identities = append(identities, identity)
+			rest = remaining
+			continue
+		}
+
+		x25519Identities, err := parseX25519Identities(rest)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, x25519Identities...)
+		break
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("no identities found in identity file")
+	}
+
+	return identities, nil
+}
+
+func parseX25519Identities(data []byte) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		identity, err := age.ParseX25519Identity(line)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to parse age identity"))
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+// ParseRecipients parses a recipients file with one recipient per line, either native X25519
+// recipients (age1...) or SSH public keys. Empty lines and lines starting with # are ignored
+func ParseRecipients(data []byte) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var recipient age.Recipient
+		var err error
+		if strings.HasPrefix(line, "age1") {
+			recipient, err = age.ParseX25519Recipient(line)
+		} else {
+			recipient, err = agessh.ParseRecipient(line)
+		}
+
+		if err != nil {
+			return nil, errors.Join(err, fmt.Errorf("invalid recipient '%s'", line))
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients found")
+	}
+
+	return recipients, nil
+}
+
+// EncryptSecret encrypts the data to all the recipients, any of their identities can decrypt it
+func EncryptSecret(recipients []age.Recipient, data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := age.Encrypt(&b, recipients...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse age identities: %w", err)
+		return nil, fmt.Errorf("failed to encrypt: %w", err)
 	}
 
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %w", err)
+	}
+
+	return b.Bytes(), nil
+}
+
+// DecryptSecret decrypts an age encrypted file, using any of the identities
+func DecryptSecret(identities []age.Identity, fileName string, data []byte) ([]byte, error) {
 	src := bytes.NewReader(data)
-	r, err := age.Decrypt(src, ident)
+	r, err := age.Decrypt(src, identities...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt '%s' age identities: %w", fileName, err)
+		return nil, fmt.Errorf("failed to decrypt '%s' using %s identities: %w", fileName, identityTypes(identities), err)
 	}
 
 	var b bytes.Buffer
@@ -28,3 +142,27 @@ func decryptSecret(decryptionKey []byte, fileName string, data []byte) ([]byte,
 
 	return b.Bytes(), nil
 }
+
+// identityTypes describes the types of identities, like "X25519, ssh-ed25519"
+func identityTypes(identities []age.Identity) string {
+	var types []string
+	for _, identity := range identities {
+		var name string
+		switch identity.(type) {
+		case *age.X25519Identity:
+			name = "X25519"
+		case *agessh.Ed25519Identity:
+			name = "ssh-ed25519"
+		case *agessh.RSAIdentity:
+			name = "ssh-rsa"
+		default:
+			name = fmt.Sprintf("%T", identity)
+		}
+
+		if !slices.Contains(types, name) {
+			types = append(types, name)
+		}
+	}
+
+	return strings.Join(types, ", ")
+}
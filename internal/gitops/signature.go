@@ -0,0 +1,181 @@
+package gitops
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+)
+
+// ErrUntrustedCommit is returned when a commit is not signed by one of the trusted keys
+var ErrUntrustedCommit = errors.New("commit is not signed by a trusted key")
+
+const sshSignatureMagic = "SSHSIG"
+
+// verifyCommit checks that the commit is signed by one of the trusted OpenPGP or SSH keys.
+// If no trusted keys are configured, all commits are accepted
+func (g *GitOps) verifyCommit(commit *object.Commit) error {
+	if g.repo.TrustedGPGKeys == "" && len(g.repo.TrustedSSHKeys) == 0 {
+		return nil
+	}
+
+	if commit.PGPSignature == "" {
+		return errors.Join(ErrUntrustedCommit, fmt.Errorf("commit '%s' is not signed", commit.Hash))
+	}
+
+	if strings.HasPrefix(commit.PGPSignature, "-----BEGIN SSH SIGNATURE-----") {
+		return g.verifySSHSignature(commit)
+	}
+
+	if g.repo.TrustedGPGKeys == "" {
+		return errors.Join(ErrUntrustedCommit, fmt.Errorf("commit '%s' has an OpenPGP signature, but no OpenPGP keys are trusted", commit.Hash))
+	}
+
+	entity, err := commit.Verify(g.repo.TrustedGPGKeys)
+	if err != nil {
+		return errors.Join(ErrUntrustedCommit, err, fmt.Errorf("invalid OpenPGP signature on commit '%s'", commit.Hash))
+	}
+
+	for name := range entity.Identities {
+		logCommitSigner(commit, name)
+		break
+	}
+
+	return nil
+}
+
+// verifySSHSignature verifies a commit signed using the sshsig format, as used by git
+// when gpg.format is set to ssh. See PROTOCOL.sshsig in the OpenSSH source for the format
+func (g *GitOps) verifySSHSignature(commit *object.Commit) error {
+	block, _ := pem.Decode([]byte(commit.PGPSignature))
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return errors.Join(ErrUntrustedCommit, fmt.Errorf("invalid SSH signature on commit '%s'", commit.Hash))
+	}
+
+	var sig struct {
+		Magic         [6]byte
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes, &sig); err != nil || string(sig.Magic[:]) != sshSignatureMagic || sig.Version != 1 {
+		return errors.Join(ErrUntrustedCommit, fmt.Errorf("invalid SSH signature on commit '%s'", commit.Hash))
+	}
+
+	if sig.Namespace != "git" {
+		return errors.Join(ErrUntrustedCommit, fmt.Errorf("SSH signature on commit '%s' has invalid namespace '%s'", commit.Hash, sig.Namespace))
+	}
+
+	publicKey, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return errors.Join(ErrUntrustedCommit, err, fmt.Errorf("invalid SSH signature key on commit '%s'", commit.Hash))
+	}
+
+	if !g.isTrustedSSHKey(publicKey) {
+		return errors.Join(ErrUntrustedCommit, fmt.Errorf("commit '%s' is signed by untrusted key %s", commit.Hash, ssh.FingerprintSHA256(publicKey)))
+	}
+
+	signature := new(ssh.Signature)
+	if err := ssh.Unmarshal(sig.Signature, signature); err != nil {
+		return errors.Join(ErrUntrustedCommit, err, fmt.Errorf("invalid SSH signature on commit '%s'", commit.Hash))
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return errors.Join(ErrUntrustedCommit, fmt.Errorf("unsupported SSH signature hash algorithm '%s'", sig.HashAlgorithm))
+	}
+
+	// the signed message is the commit without the signature header
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		return errors.Join(err, errors.New("failed to encode commit"))
+	}
+
+	reader, err := encoded.Reader()
+	if err != nil {
+		return errors.Join(err, errors.New("failed to read commit"))
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(h, reader); err != nil {
+		return errors.Join(err, errors.New("failed to read commit"))
+	}
+
+	signedData := ssh.Marshal(struct {
+		Magic         [6]byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Magic, sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})
+
+	if err := publicKey.Verify(signedData, signature); err != nil {
+		return errors.Join(ErrUntrustedCommit, err, fmt.Errorf("invalid SSH signature on commit '%s'", commit.Hash))
+	}
+
+	logCommitSigner(commit, ssh.FingerprintSHA256(publicKey))
+	return nil
+}
+
+func (g *GitOps) isTrustedSSHKey(key ssh.PublicKey) bool {
+	for _, trusted := range g.repo.TrustedSSHKeys {
+		if bytes.Equal(trusted.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseSSHSigningKeys parses trusted ssh keys from either the authorized_keys or the
+// allowed_signers format, where each key is prefixed with the principals allowed to sign
+func ParseSSHSigningKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// skip principals and options, until we find the key itself
+		var key ssh.PublicKey
+		fields := strings.Fields(line)
+		for i := range fields {
+			parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+			if err == nil {
+				key = parsed
+				break
+			}
+		}
+
+		if key == nil {
+			return nil, fmt.Errorf("invalid ssh signing key '%s'", line)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func logCommitSigner(commit *object.Commit, signer string) {
+	slog.Info("verified commit signature", slog.String("commit_hash", commit.Hash.String()), slog.String("signer", signer))
+}
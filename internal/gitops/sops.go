@@ -0,0 +1,440 @@
+package gitops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrSOPSMacMismatch is returned when the values of a SOPS file don't match its MAC, meaning the file was tampered with
+var ErrSOPSMacMismatch = errors.New("sops file MAC mismatch")
+
+// sopsMacOnlyEncryptedInitialization seeds the MAC of files with mac_only_encrypted set, so the MAC of a file
+// without encrypted values can't be mistaken for the MAC of a file using the default
+var sopsMacOnlyEncryptedInitialization = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0x0b, 0x0b, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+var sopsEncryptedValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsMetadata is the part of the sops metadata needed to decrypt a file, only the age backend is supported
+type sopsMetadata struct {
+	Age              []sopsAgeRecipient `yaml:"age"`
+	LastModified     string             `yaml:"lastmodified"`
+	Mac              string             `yaml:"mac"`
+	MacOnlyEncrypted bool               `yaml:"mac_only_encrypted"`
+}
+
+// sopsAgeRecipient is the data key encrypted for an age recipient
+type sopsAgeRecipient struct {
+	Recipient string `yaml:"recipient"`
+	Enc       string `yaml:"enc"`
+}
+
+// sopsFileName returns the name of the decrypted file, if the file is a sops file.
+// Files named <name>.sops.yaml and <name>.sops.env are decrypted to <name>.yaml and <name>.env
+func sopsFileName(fileName string) (string, bool) {
+	ext := path.Ext(fileName)
+	if ext != ".yaml" && ext != ".yml" && ext != ".env" {
+		return "", false
+	}
+
+	name, ok := strings.CutSuffix(strings.TrimSuffix(fileName, ext), ".sops")
+	if !ok {
+		return "", false
+	}
+
+	return name + ext, true
+}
+
+// decryptSOPSFile decrypts the values of a sops encrypted yaml or env file, and verifies the MAC of the file
+func decryptSOPSFile(identities []age.Identity, fileName string, data []byte) ([]byte, error) {
+	var decrypted []byte
+	var err error
+	if path.Ext(fileName) == ".env" {
+		decrypted, err = decryptSOPSEnv(identities, data)
+	} else {
+		decrypted, err = decryptSOPSYAML(identities, data)
+	}
+
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to decrypt sops file '%s'", fileName))
+	}
+
+	return decrypted, nil
+}
+
+func decryptSOPSYAML(identities []age.Identity, data []byte) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, errors.Join(err, errors.New("invalid yaml"))
+	}
+
+	if len(document.Content) != 1 || document.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("invalid sops file, expected a mapping")
+	}
+
+	// the metadata is stored in the sops key, and is not part of the decrypted file
+	root := document.Content[0]
+	var metadata *sopsMetadata
+	var content []*yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "sops" {
+			metadata = &sopsMetadata{}
+			if err := root.Content[i+1].Decode(metadata); err != nil {
+				return nil, errors.Join(err, errors.New("invalid sops metadata"))
+			}
+			continue
+		}
+
+		content = append(content, root.Content[i], root.Content[i+1])
+	}
+
+	if metadata == nil {
+		return nil, errors.New("invalid sops file, metadata not found")
+	}
+
+	key, err := metadata.dataKey(identities)
+	if err != nil {
+		return nil, err
+	}
+
+	root.Content = content
+	mac := metadata.newMac()
+	if err := decryptSOPSNode(key, root, nil, metadata.MacOnlyEncrypted, mac); err != nil {
+		return nil, err
+	}
+
+	if err := metadata.verifyMac(key, mac); err != nil {
+		return nil, err
+	}
+
+	removeSOPSComments(&document)
+	return yaml.Marshal(&document)
+}
+
+// removeSOPSComments removes encrypted comments, as they are not part of the MAC they can't be trusted
+func removeSOPSComments(node *yaml.Node) {
+	for _, comment := range []*string{&node.HeadComment, &node.LineComment, &node.FootComment} {
+		var lines []string
+		for _, line := range strings.Split(*comment, "\n") {
+			if !strings.Contains(line, "ENC[AES256_GCM") {
+				lines = append(lines, line)
+			}
+		}
+		*comment = strings.Join(lines, "\n")
+	}
+
+	for _, child := range node.Content {
+		removeSOPSComments(child)
+	}
+}
+
+// decryptSOPSNode decrypts all values in the node, the path is the keys leading to
+// the value, and is used as additional data when decrypting. Items in lists use the
+// path of the list. Values are added to the MAC in the order they appear in the file
+func decryptSOPSNode(key []byte, node *yaml.Node, keyPath []string, macOnlyEncrypted bool, mac hash.Hash) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := append(append([]string{}, keyPath...), node.Content[i].Value)
+			if err := decryptSOPSNode(key, node.Content[i+1], childPath, macOnlyEncrypted, mac); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := decryptSOPSNode(key, child, keyPath, macOnlyEncrypted, mac); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !sopsEncryptedValue.MatchString(node.Value) {
+			if !macOnlyEncrypted {
+				mac.Write(sopsYAMLMacValue(node))
+			}
+			return nil
+		}
+
+		plaintext, dataType, err := decryptSOPSValue(key, node.Value, strings.Join(keyPath, ":")+":")
+		if err != nil {
+			return err
+		}
+
+		node.Value = plaintext
+		node.Style = 0
+		switch dataType {
+		case "int":
+			node.Tag = "!!int"
+		case "float":
+			node.Tag = "!!float"
+		case "bool":
+			node.Tag = "!!bool"
+			node.Value = strings.ToLower(plaintext)
+		default:
+			node.Tag = "!!str"
+		}
+
+		macValue, err := sopsMacValue(plaintext, dataType)
+		if err != nil {
+			return err
+		}
+		mac.Write(macValue)
+	}
+
+	return nil
+}
+
+func decryptSOPSEnv(identities []age.Identity, data []byte) ([]byte, error) {
+	type envLine struct {
+		key     string
+		value   string
+		comment bool
+	}
+
+	var lines []envLine
+	metadataValues := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			lines = append(lines, envLine{value: line, comment: true})
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid env line '%s'", line)
+		}
+
+		// sops escapes new lines in values
+		value = strings.ReplaceAll(value, "\\n", "\n")
+		if metadataKey, ok := strings.CutPrefix(key, "sops_"); ok {
+			metadataValues[metadataKey] = value
+			continue
+		}
+
+		lines = append(lines, envLine{key: key, value: value})
+	}
+
+	// the metadata is flattened into keys like sops_age__list_0__map_enc
+	metadata := &sopsMetadata{
+		LastModified:     metadataValues["lastmodified"],
+		Mac:              metadataValues["mac"],
+		MacOnlyEncrypted: metadataValues["mac_only_encrypted"] == "true",
+	}
+	for i := 0; ; i++ {
+		enc, ok := metadataValues[fmt.Sprintf("age__list_%d__map_enc", i)]
+		if !ok {
+			break
+		}
+
+		metadata.Age = append(metadata.Age, sopsAgeRecipient{
+			Recipient: metadataValues[fmt.Sprintf("age__list_%d__map_recipient", i)],
+			Enc:       enc,
+		})
+	}
+
+	key, err := metadata.dataKey(identities)
+	if err != nil {
+		return nil, err
+	}
+
+	var decrypted bytes.Buffer
+	mac := metadata.newMac()
+	for _, line := range lines {
+		if line.comment {
+			if !strings.Contains(line.value, "ENC[AES256_GCM") {
+				decrypted.WriteString(line.value + "\n")
+			}
+			continue
+		}
+
+		if !sopsEncryptedValue.MatchString(line.value) {
+			if !metadata.MacOnlyEncrypted {
+				mac.Write([]byte(line.value))
+			}
+			decrypted.WriteString(line.key + "=" + strings.ReplaceAll(line.value, "\n", "\\n") + "\n")
+			continue
+		}
+
+		plaintext, dataType, err := decryptSOPSValue(key, line.value, line.key+":")
+		if err != nil {
+			return nil, err
+		}
+
+		macValue, err := sopsMacValue(plaintext, dataType)
+		if err != nil {
+			return nil, err
+		}
+		mac.Write(macValue)
+
+		decrypted.WriteString(line.key + "=" + strings.ReplaceAll(plaintext, "\n", "\\n") + "\n")
+	}
+
+	if err := metadata.verifyMac(key, mac); err != nil {
+		return nil, err
+	}
+
+	return decrypted.Bytes(), nil
+}
+
+// dataKey decrypts the key used to encrypt the values, using the first age recipient one of the identities can decrypt
+func (m *sopsMetadata) dataKey(identities []age.Identity) ([]byte, error) {
+	if len(m.Age) == 0 {
+		return nil, errors.New("sops file has no age recipients, only age is supported")
+	}
+
+	var errs []error
+	for _, recipient := range m.Age {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(recipient.Enc))), identities...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		key, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to read sops data key"))
+		}
+
+		return key, nil
+	}
+
+	return nil, errors.Join(errors.Join(errs...), fmt.Errorf("failed to decrypt sops data key using %s identities", identityTypes(identities)))
+}
+
+// newMac returns the hash the values are added to, when only encrypted values are part of the MAC it's seeded
+func (m *sopsMetadata) newMac() hash.Hash {
+	mac := sha512.New()
+	if m.MacOnlyEncrypted {
+		mac.Write(sopsMacOnlyEncryptedInitialization)
+	}
+
+	return mac
+}
+
+// verifyMac compares the MAC of the decrypted values, with the MAC stored in the file.
+// The stored MAC is encrypted using the last modified timestamp as additional data
+func (m *sopsMetadata) verifyMac(key []byte, mac hash.Hash) error {
+	lastModified, err := time.Parse(time.RFC3339, m.LastModified)
+	if err != nil {
+		return errors.Join(err, errors.New("invalid sops last modified timestamp"))
+	}
+
+	fileMac, _, err := decryptSOPSValue(key, m.Mac, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return errors.Join(ErrSOPSMacMismatch, err)
+	}
+
+	if fileMac != fmt.Sprintf("%X", mac.Sum(nil)) {
+		return ErrSOPSMacMismatch
+	}
+
+	return nil
+}
+
+// decryptSOPSValue decrypts a value in the ENC[AES256_GCM,data:...,iv:...,tag:...,type:...] format
+func decryptSOPSValue(key []byte, value string, additionalData string) (string, string, error) {
+	match := sopsEncryptedValue.FindStringSubmatch(value)
+	if match == nil {
+		return "", "", errors.New("invalid sops encrypted value")
+	}
+
+	var parts [3][]byte
+	for i := range parts {
+		decoded, err := base64.StdEncoding.DecodeString(match[i+1])
+		if err != nil {
+			return "", "", errors.Join(err, errors.New("invalid sops encrypted value"))
+		}
+		parts[i] = decoded
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", "", errors.Join(err, errors.New("invalid sops data key"))
+	}
+
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", "", errors.Join(err, errors.New("invalid sops encrypted value"))
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", "", errors.Join(ErrSOPSMacMismatch, err, errors.New("failed to decrypt sops value"))
+	}
+
+	return string(plaintext), match[4], nil
+}
+
+// sopsMacValue returns the bytes of a value that are added to the MAC, like sops does
+func sopsMacValue(plaintext string, dataType string) ([]byte, error) {
+	switch dataType {
+	case "int":
+		i, err := strconv.Atoi(plaintext)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("invalid sops int value"))
+		}
+		return []byte(strconv.Itoa(i)), nil
+	case "float":
+		f, err := strconv.ParseFloat(plaintext, 64)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("invalid sops float value"))
+		}
+		return []byte(strconv.FormatFloat(f, 'f', -1, 64)), nil
+	case "bool":
+		b, err := strconv.ParseBool(plaintext)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("invalid sops bool value"))
+		}
+		return sopsBool(b), nil
+	default:
+		return []byte(plaintext), nil
+	}
+}
+
+// sopsYAMLMacValue returns the bytes of an unencrypted yaml value that are added to the MAC
+func sopsYAMLMacValue(node *yaml.Node) []byte {
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return []byte(node.Value)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case int:
+		return []byte(strconv.Itoa(v))
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		return sopsBool(v)
+	default:
+		return []byte(node.Value)
+	}
+}
+
+func sopsBool(b bool) []byte {
+	if b {
+		return []byte("True")
+	}
+
+	return []byte("False")
+}
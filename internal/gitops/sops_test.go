@@ -0,0 +1,84 @@
+package gitops
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSOPSIdentity decrypts the files in testdata/sops, they are encrypted by sops for its recipient
+const testSOPSIdentity = "AGE-SECRET-KEY-1S97YGM9Y27D66NZLVH55WZ5EWQZSZL05GVNUEWSJ49WXCRY6XCEQYG2UHF"
+
+func TestDecryptSOPSFile(t *testing.T) {
+	identities, err := ParseIdentities([]byte(testSOPSIdentity))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file     string
+		expected []string
+	}{
+		{"secrets.sops.yaml", []string{"user: admin", "password: s3cret", "port: 5432", "host_unencrypted: db.local"}},
+		{"mac-only.sops.yaml", []string{"user: admin", "password: s3cret", "port: 5432", "host_unencrypted: db.local"}},
+		{"secrets.sops.env", []string{"DB_PASS=hunter2", "DB_HOST_unencrypted=db.local"}},
+		{"mac-only.sops.env", []string{"DB_PASS=hunter2", "DB_HOST_unencrypted=db.local"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "sops", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decrypted, err := decryptSOPSFile(identities, test.file, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, expected := range test.expected {
+				if !strings.Contains(string(decrypted), expected) {
+					t.Errorf("expected '%s' in decrypted file:\n%s", expected, decrypted)
+				}
+			}
+			if strings.Contains(string(decrypted), "sops") {
+				t.Errorf("expected the sops metadata to be removed:\n%s", decrypted)
+			}
+		})
+	}
+}
+
+func TestDecryptSOPSFileMacMismatch(t *testing.T) {
+	identities, err := ParseIdentities([]byte(testSOPSIdentity))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file     string
+		original string
+		changed  string
+	}{
+		{"secrets.sops.yaml", "host_unencrypted: db.local", "host_unencrypted: evil.local"},
+		{"secrets.sops.env", "DB_HOST_unencrypted=db.local", "DB_HOST_unencrypted=evil.local"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "sops", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// unencrypted values are part of the MAC, unless mac_only_encrypted is set
+			tampered := strings.Replace(string(data), test.original, test.changed, 1)
+			_, err = decryptSOPSFile(identities, test.file, []byte(tampered))
+			if !errors.Is(err, ErrSOPSMacMismatch) {
+				t.Fatalf("expected ErrSOPSMacMismatch, got %v", err)
+			}
+		})
+	}
+}
@@ -3,107 +3,323 @@ package gitops
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-git/go-billy/v5/memfs"
+	"filippo.io/age"
 	"github.com/go-git/go-billy/v5/util"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/patrickfnielsen/gear/internal/secrets"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/exp/slog"
 )
 
 type Repository struct {
-	Url    string
-	Branch string
-	SSHKey []byte
+	Url            string
+	Branch         string
+	Tag            string
+	Commit         string
+	AllowDowngrade bool
+	Path           string
+	CacheDirectory string
+	Include        []string
+	Exclude        []string
+
+	SSHKey   []byte
+	Username string
+	Token    []byte
+
+	KnownHostsFile      string
+	HostKeyFingerprints []string
+	TrustOnFirstUse     bool
+
+	TrustedGPGKeys string
+	TrustedSSHKeys []gossh.PublicKey
 }
 
 type RepositoryUpdateAvailable struct {
 	Available bool
 	OldHash   string
 	NewHash   string
+	NewRef    string
 }
 
 type BundleFile struct {
 	FileName        string
 	Data            []byte
+	Mode            os.FileMode
 	IsCustomisation bool
+	IsSecret        bool
+
+	// the position of a customisation in the layering of the overrides, higher layers are applied last
+	Layer int
 }
 
 type Bundle struct {
 	Hash  string
+	Ref   string
+	Tree  string
 	Files []BundleFile
+
+	// Projects are the projects from the manifest, nil if the repository has no manifest
+	Projects []BundleProject
 }
 
+// SyncState is the last deployed commit, used to decide if there's an update to deploy.
+// When ForceDeploy is set, the current commit is deployed again on the first sync
+type SyncState struct {
+	CurrentHash string
+	CurrentRef  string
+	CurrentTree string
+	FailedHash  string
+	// RolledBackHash is a commit that was rolled back, it's not deployed again
+	RolledBackHash string
+	ForceDeploy    bool
+}
+
+// SyncLock is taken before each sync, so another gear process can't deploy the repository during the sync.
+// It returns the function releasing the lock
+type SyncLock func() (func(), error)
+
 type GitOps struct {
-	repo          Repository
-	encryptionKey []byte
-	customiseName string
-	currentHash   string
+	repo            Repository
+	identities      []age.Identity
+	secretProviders map[string]secrets.Provider
+	host            Host
+	currentHash     string
+	currentRef      string
+	currentTree     string
+	failedHash      string
+	rolledBackHash  string
+	forceDeploy     bool
+	trigger         chan struct{}
 }
 
-func NewGitSync(customiseName string, currentHash string, encryptionKey []byte, repo Repository) *GitOps {
-	return &GitOps{
-		customiseName: customiseName,
-		repo:          repo,
-		currentHash:   currentHash,
-		encryptionKey: encryptionKey,
+func NewGitSync(host Host, syncState SyncState, identities []age.Identity, secretProviders map[string]secrets.Provider, repo Repository) *GitOps {
+	g := &GitOps{
+		host:            host,
+		repo:            repo,
+		identities:      identities,
+		secretProviders: secretProviders,
+		trigger:         make(chan struct{}, 1),
 	}
+
+	g.SetState(syncState)
+	return g
+}
+
+// SetState replaces the state the repository is synced from, it's used when the deployment state was changed
+// by another gear process. It must not be called during a sync
+func (g *GitOps) SetState(syncState SyncState) {
+	g.currentHash = syncState.CurrentHash
+	g.currentRef = syncState.CurrentRef
+	g.currentTree = syncState.CurrentTree
+	g.failedHash = syncState.FailedHash
+	g.rolledBackHash = syncState.RolledBackHash
+	g.forceDeploy = syncState.ForceDeploy
 }
 
-func (g *GitOps) StartSync(ctx context.Context, syncInterval int, bundleActivator func(*Bundle) error) {
+// StartSync syncs the repository on the interval until the context is cancelled, the wait group
+// is done when the sync has stopped, so a deployment in progress is rolled back before gear exits.
+// The lock is taken before each sync, and released when the sync is done
+func (g *GitOps) StartSync(ctx context.Context, wg *sync.WaitGroup, syncInterval int, syncLock SyncLock, bundleActivator func(*Bundle) error) {
 	updateTicker := time.NewTicker(time.Second * time.Duration(syncInterval))
 
+	wg.Add(1)
 	go func(ctx context.Context) {
+		defer wg.Done()
 		defer updateTicker.Stop()
 
-		for range updateTicker.C {
-			if ctx.Err() != nil {
+		for {
+			select {
+			case <-ctx.Done():
 				return
+			case <-updateTicker.C:
+			case <-g.trigger:
+				slog.Debug("sync triggered", slog.String("repo", g.repo.Url))
 			}
 
-			update, err := g.CheckForUpdates()
+			unlock, err := syncLock()
 			if err != nil {
-				slog.Error("Failed to check for project updates", err, slog.String("repo", g.repo.Url))
+				slog.Error("failed to lock deployment state", slog.String("repo", g.repo.Url), slog.String("error", err.Error()))
 				continue
 			}
 
-			slog.Debug(
-				"Checking for project updates",
-				slog.String("repo", g.repo.Url),
-				slog.Bool("update_avaliable", update.Available),
-				slog.String("new_hash", update.NewHash),
-				slog.String("old_hash", update.OldHash),
-			)
-
-			if update.Available {
-				bundle, err := g.GenerateBundle()
-				if err != nil {
-					slog.Error("failed to create bundle", err, slog.String("repo", g.repo.Url))
-				}
-
-				err = bundleActivator(bundle)
-				if err != nil {
-					slog.Error("failed to activate bundle", slog.String("error", err.Error()))
-					continue
-				}
-
-				// make sure we update the current version if activation was successfull
-				g.currentHash = update.NewHash
-			}
+			// errors are logged by the sync, and it's tried again on the next tick
+			g.syncRepository(bundleActivator)
+			unlock()
 		}
 	}(ctx)
 }
 
+// SyncOnce checks for an update and activates it, returning an error if the update could not be deployed
+func (g *GitOps) SyncOnce(bundleActivator func(*Bundle) error) error {
+	return g.syncRepository(bundleActivator)
+}
+
+// TriggerSync requests an immediate sync, without waiting for the sync interval.
+// If a sync is already pending the request is dropped
+func (g *GitOps) TriggerSync() {
+	select {
+	case g.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (g *GitOps) syncRepository(bundleActivator func(*Bundle) error) error {
+	if g.forceDeploy {
+		if err := g.redeployCurrent(bundleActivator); err != nil {
+			return err
+		}
+	}
+
+	update, err := g.CheckForUpdates()
+	if errors.Is(err, ErrRefNotFound) {
+		slog.Error("configured ref not found on remote", slog.String("repo", g.repo.Url), slog.String("error", err.Error()))
+		return err
+	}
+
+	if err != nil {
+		slog.Error("Failed to check for project updates", err, slog.String("repo", g.repo.Url))
+		return err
+	}
+
+	slog.Debug(
+		"Checking for project updates",
+		slog.String("repo", g.repo.Url),
+		slog.Bool("update_avaliable", update.Available),
+		slog.String("new_hash", update.NewHash),
+		slog.String("old_hash", update.OldHash),
+	)
+
+	// don't retry a commit that already failed, wait for a newer one
+	if update.Available && update.NewHash == g.failedHash {
+		slog.Debug("skipping failed commit", slog.String("repo", g.repo.Url), slog.String("failed_hash", g.failedHash))
+		return nil
+	}
+
+	if update.Available && update.NewHash == g.rolledBackHash {
+		slog.Debug("skipping rolled back commit", slog.String("repo", g.repo.Url), slog.String("rolled_back_hash", g.rolledBackHash))
+		return nil
+	}
+
+	if update.Available {
+		bundle, err := g.GenerateBundle()
+		if errors.Is(err, ErrUntrustedCommit) {
+			// keep running the last verified commit, and don't check this one again
+			slog.Warn("skipping untrusted commit", slog.String("repo", g.repo.Url), slog.String("error", err.Error()))
+			g.failedHash = update.NewHash
+			return err
+		}
+
+		if errors.Is(err, ErrDowngrade) {
+			// keep running the deployed commit, and don't check this one again
+			slog.Warn("skipping tag moved to an older commit", slog.String("repo", g.repo.Url), slog.String("tag", update.NewRef), slog.String("error", err.Error()))
+			g.failedHash = update.NewHash
+			return err
+		}
+
+		if errors.Is(err, ErrTemplate) {
+			slog.Error("failed to render bundle", slog.String("repo", g.repo.Url), slog.String("commit_hash", update.NewHash), slog.String("error", err.Error()))
+			g.failedHash = update.NewHash
+			return err
+		}
+
+		if err != nil {
+			slog.Error("failed to create bundle", err, slog.String("repo", g.repo.Url))
+			return err
+		}
+
+		// when deploying a sub directory, only changes inside it are deployed
+		if g.repo.Path != "" && bundle.Tree == g.currentTree {
+			slog.Debug("no changes in repository path", slog.String("repo", g.repo.Url), slog.String("path", g.repo.Path), slog.String("new_hash", update.NewHash))
+			g.currentHash = update.NewHash
+			g.currentRef = bundle.Ref
+			return nil
+		}
+
+		err = bundleActivator(bundle)
+		if err != nil {
+			slog.Error("failed to activate bundle", slog.String("error", err.Error()))
+			g.failedHash = update.NewHash
+			return err
+		}
+
+		// make sure we update the current version if activation was successfull
+		g.currentHash = update.NewHash
+		g.currentRef = bundle.Ref
+		g.currentTree = bundle.Tree
+	}
+
+	return nil
+}
+
+// redeployCurrent deploys the current commit again, pinned to the commit so it's the same one even if the
+// remote has moved on. It's used to restore the secrets of the current deployment after a restart
+func (g *GitOps) redeployCurrent(bundleActivator func(*Bundle) error) error {
+	if g.currentHash == "" {
+		g.forceDeploy = false
+		return nil
+	}
+
+	slog.Info("deploying current commit again", slog.String("repo", g.repo.Url), slog.String("commit_hash", g.currentHash))
+	pinned := *g
+	pinned.repo.Commit = g.currentHash
+	pinned.repo.Tag = ""
+
+	bundle, err := pinned.GenerateBundle()
+	if err != nil {
+		// it's tried again on the next sync
+		slog.Error("failed to create bundle of current commit", slog.String("repo", g.repo.Url), slog.String("commit_hash", g.currentHash), slog.String("error", err.Error()))
+		return err
+	}
+
+	if g.currentRef != "" {
+		bundle.Ref = g.currentRef
+	}
+
+	g.forceDeploy = false
+	if err := bundleActivator(bundle); err != nil {
+		slog.Error("failed to deploy current commit again", slog.String("repo", g.repo.Url), slog.String("commit_hash", g.currentHash), slog.String("error", err.Error()))
+		return err
+	}
+
+	return nil
+}
+
 func (g *GitOps) GenerateBundle() (*Bundle, error) {
-	repo, err := g.getGitRepo()
+	repo, refName, err := g.getGitRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := repo.Head()
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to get head"))
+	}
+
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to get head commit"))
+	}
+
+	if err := g.verifyCommit(commit); err != nil {
+		return nil, err
+	}
+
+	tree, err := getPathTree(commit, g.repo.Path)
 	if err != nil {
 		return nil, err
 	}
@@ -113,9 +329,37 @@ func (g *GitOps) GenerateBundle() (*Bundle, error) {
 		return nil, errors.Join(err, errors.New("failed to get worktree"))
 	}
 
+	// only bundle files inside the configured path, with paths relative to it
+	fs := wt.Filesystem
+	if g.repo.Path != "" {
+		fs, err = fs.Chroot(g.repo.Path)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to open repository path"))
+		}
+	}
+
+	filter, err := g.getFileFilter(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := readManifest(fs)
+	if err != nil {
+		return nil, err
+	}
+
 	var bundleFiles []BundleFile
-	err = util.Walk(wt.Filesystem, "", func(fileName string, fi os.FileInfo, err error) error {
-		if !fi.Mode().IsRegular() || err != nil {
+	err = util.Walk(fs, "", func(fileName string, fi os.FileInfo, err error) error {
+		// a cached repository has a .git file in the worktree pointing to it, which isn't part of the commit
+		if err == nil && path.Base(fileName) == git.GitDirName {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if err != nil || !fi.Mode().IsRegular() {
 			return nil
 		}
 
@@ -124,50 +368,62 @@ func (g *GitOps) GenerateBundle() (*Bundle, error) {
 			return nil
 		}
 
-		// if we are in the customise directory, only get customisations for this service
+		if !filter.isIncluded(fileName) {
+			return nil
+		}
+
+		// if we are in the customise directory, only get customisations for this host
 		isCustomisation := false
+		layer := 0
 		if strings.HasPrefix(fileName, "customise/") {
 			isCustomisation = true
 
-			if !strings.Contains(fileName, g.customiseName) {
+			parts := strings.SplitN(fileName, "/", 3)
+			if len(parts) != 3 || !g.host.matchesCustomisation(parts[1]) {
 				return nil
 			}
+
+			layer = g.host.customisationLayer(parts[1])
 		}
 
-		file, err := wt.Filesystem.Open(fileName)
-		defer file.Close()
+		data, err := util.ReadFile(fs, fileName)
 		if err != nil {
-			return errors.Join(err, errors.New("failed to open file"))
+			return errors.Join(err, errors.New("failed to read file"))
 		}
 
-		// handle yaml, json, and env files only
-		extension := path.Ext(fileName)
-		if extension == ".yaml" || extension == ".json" || extension == ".env" || extension == ".enc" {
-			fileName := filepath.Base(fileName)
-			bFile := BundleFile{
-				FileName:        fileName,
-				Data:            make([]byte, fi.Size()),
-				IsCustomisation: isCustomisation,
-			}
+		bFile := BundleFile{
+			FileName:        fileName,
+			Data:            data,
+			Mode:            fi.Mode().Perm(),
+			IsCustomisation: isCustomisation,
+			Layer:           layer,
+		}
 
-			if _, err := file.Read(bFile.Data); err != nil {
-				return errors.Join(err, errors.New("failed to read file"))
+		// handle encrypted files
+		if path.Ext(fileName) == ".enc" && len(g.identities) > 0 {
+			data, err := DecryptSecret(g.identities, fileName, bFile.Data)
+			if err != nil {
+				return errors.Join(err, errors.New("failed to decrypt secret"))
 			}
 
-			// handle encrypted files
-			if extension == ".enc" && g.encryptionKey != nil {
-				data, err := decryptSecret(g.encryptionKey, fileName, bFile.Data)
-				if err != nil {
-					return errors.Join(err, errors.New("failed to decrypt secret"))
-				}
+			bFile.FileName = strings.TrimSuffix(fileName, ".enc")
+			bFile.Data = data
+			bFile.IsSecret = true
+		}
 
-				bFile.FileName = strings.ReplaceAll(fileName, ".enc", "")
-				bFile.Data = data
+		// handle sops files, where only the values are encrypted
+		if name, ok := sopsFileName(fileName); ok && len(g.identities) > 0 {
+			data, err := decryptSOPSFile(g.identities, fileName, bFile.Data)
+			if err != nil {
+				return errors.Join(err, errors.New("failed to decrypt secret"))
 			}
 
-			bundleFiles = append(bundleFiles, bFile)
+			bFile.FileName = name
+			bFile.Data = data
+			bFile.IsSecret = true
 		}
 
+		bundleFiles = append(bundleFiles, bFile)
 		return nil
 	})
 
@@ -175,15 +431,55 @@ func (g *GitOps) GenerateBundle() (*Bundle, error) {
 		return nil, errors.Join(err, errors.New("failed to walk fs"))
 	}
 
-	ref, _ := repo.Head()
+	// templates are rendered before anything is deployed, so a broken template fails the whole bundle
+	bundleFiles, err = g.renderTemplates(bundleFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleFiles, err = g.resolveSecretReferences(bundleFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var projects []BundleProject
+	if manifest != nil {
+		projects, err = manifest.getProjects(g.host, bundleFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Bundle{
-		Hash:  ref.Hash().String(),
-		Files: bundleFiles,
+		Hash:     commit.Hash.String(),
+		Ref:      refName,
+		Tree:     tree.Hash.String(),
+		Files:    bundleFiles,
+		Projects: projects,
 	}, nil
 }
 
+// getPathTree returns the tree of the path in the commit, or the root tree if the path is empty
+func getPathTree(commit *object.Commit, path string) (*object.Tree, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to get commit tree"))
+	}
+
+	if path == "" {
+		return tree, nil
+	}
+
+	tree, err = tree.Tree(path)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to find path '%s' in repository", path))
+	}
+
+	return tree, nil
+}
+
 func (g *GitOps) CheckForUpdates() (*RepositoryUpdateAvailable, error) {
-	head, err := g.getGitRemoteHead()
+	ref, head, err := g.getGitRemoteHead()
 	if err != nil {
 		return nil, err
 	}
@@ -192,19 +488,32 @@ func (g *GitOps) CheckForUpdates() (*RepositoryUpdateAvailable, error) {
 		Available: false,
 		OldHash:   g.currentHash,
 		NewHash:   head,
+		NewRef:    ref,
 	}
 
 	if update.OldHash != update.NewHash {
 		update.Available = true
 	}
 
+	// never go back to an older tag, unless downgrades are allowed
+	if update.Available && g.repo.Tag != "" && !g.repo.AllowDowngrade && g.currentRef != "" && compareTags(g.repo.Tag, ref, g.currentRef) < 0 {
+		slog.Warn("newest matching tag is older than the deployed tag, skipping downgrade", slog.String("tag", ref), slog.String("current_tag", g.currentRef))
+		update.Available = false
+	}
+
 	return &update, nil
 }
 
-func (g *GitOps) getGitRemoteHead() (string, error) {
-	authKey, err := g.getAuthKey(g.repo.SSHKey)
-	if g.repo.SSHKey != nil && err != nil {
-		return "", err
+// getGitRemoteHead returns the ref and commit hash that should be deployed
+func (g *GitOps) getGitRemoteHead() (string, string, error) {
+	// a pinned commit never changes, so there's no need to ask the remote
+	if g.repo.Commit != "" {
+		return g.repo.Commit, g.repo.Commit, nil
+	}
+
+	auth, err := g.getAuth()
+	if err != nil {
+		return "", "", err
 	}
 
 	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
@@ -212,47 +521,76 @@ func (g *GitOps) getGitRemoteHead() (string, error) {
 		URLs: []string{g.repo.Url},
 	})
 
+	peeling := git.IgnorePeeled
+	if g.repo.Tag != "" {
+		peeling = git.AppendPeeled
+	}
+
 	list, err := remote.List(&git.ListOptions{
-		Auth: authKey,
+		Auth:          auth,
+		PeelingOption: peeling,
 	})
 	if err != nil {
-		return "", errors.Join(err, errors.New("failed to list remote"))
+		return "", "", errors.Join(err, errors.New("failed to list remote"))
 	}
 
-	for _, commit := range list {
-		if !commit.Hash().IsZero() {
-			return commit.Hash().String(), nil
+	if g.repo.Tag != "" {
+		tag, hash, err := resolveTag(g.repo.Tag, list)
+		if err != nil {
+			return "", "", err
 		}
-	}
-
-	return "", errors.New("failed to find non zero commit")
-}
 
-func (g *GitOps) getGitRepo() (*git.Repository, error) {
-	authKey, err := g.getAuthKey(g.repo.SSHKey)
-	if g.repo.SSHKey != nil && err != nil {
-		return nil, err
+		return tag, hash.String(), nil
 	}
 
-	repo, err := git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{
-		URL:           g.repo.Url,
-		ReferenceName: plumbing.NewBranchReferenceName(g.repo.Branch),
-		Auth:          authKey,
-		SingleBranch:  true,
-		Depth:         1,
-	})
-	if err != nil {
-		return nil, errors.Join(err, errors.New("failed to clone"))
+	branch := plumbing.NewBranchReferenceName(g.repo.Branch)
+	for _, ref := range list {
+		if ref.Name() == branch && !ref.Hash().IsZero() {
+			return g.repo.Branch, ref.Hash().String(), nil
+		}
 	}
 
-	return repo, nil
+	return "", "", errors.Join(ErrRefNotFound, fmt.Errorf("branch '%s' not found", g.repo.Branch))
 }
 
-func (g *GitOps) getAuthKey(sshKeyData []byte) (*ssh.PublicKeys, error) {
-	authKey, err := ssh.NewPublicKeys("git", sshKeyData, "")
+// getAuth returns the auth method matching the repository url scheme, for http(s) urls
+// a token is used, either as basic auth if a username is set or as a bearer token
+func (g *GitOps) getAuth() (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(g.repo.Url)
 	if err != nil {
-		return nil, errors.Join(err, errors.New("failed to get authkey"))
+		return nil, errors.Join(err, errors.New("invalid repository url"))
 	}
 
-	return authKey, nil
+	switch endpoint.Protocol {
+	case "http", "https":
+		if g.repo.Token == nil {
+			return nil, nil
+		}
+
+		if g.repo.Username != "" {
+			return &http.BasicAuth{Username: g.repo.Username, Password: string(g.repo.Token)}, nil
+		}
+
+		return &http.TokenAuth{Token: string(g.repo.Token)}, nil
+	default:
+		if g.repo.SSHKey == nil {
+			return nil, nil
+		}
+
+		authKey, err := ssh.NewPublicKeys("git", g.repo.SSHKey, "")
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to get authkey"))
+		}
+
+		hostKeyCallback, err := g.getHostKeyCallback()
+		if err != nil {
+			return nil, err
+		}
+
+		if hostKeyCallback != nil {
+			authKey.HostKeyCallback = hostKeyCallback
+		}
+
+		return authKey, nil
+	}
 }
@@ -0,0 +1,294 @@
+package gitops
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// testRemote is a bare repository, with a work repository used to push commits to it
+type testRemote struct {
+	t    *testing.T
+	url  string
+	work *git.Repository
+	dir  string
+}
+
+func newTestRemote(t *testing.T) *testRemote {
+	t.Helper()
+	url := filepath.Join(t.TempDir(), "remote.git")
+	if _, err := git.PlainInit(url, true); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	work, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = work.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{url}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testRemote{t: t, url: url, work: work, dir: dir}
+}
+
+// commit adds a commit to the branch and pushes it, the branch is created from the current commit if it doesn't exist
+func (r *testRemote) commit(branch string, content string) plumbing.Hash {
+	r.t.Helper()
+	return r.commitFiles(branch, content, map[string]string{"file.txt": content})
+}
+
+// commitFiles adds a commit writing the files to the branch and pushes it
+func (r *testRemote) commitFiles(branch string, message string, files map[string]string) plumbing.Hash {
+	r.t.Helper()
+	wt, err := r.work.Worktree()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	if head, err := r.work.Head(); err == nil {
+		if _, err := r.work.Reference(branchRef, false); err != nil {
+			if err := r.work.Storer.SetReference(plumbing.NewHashReference(branchRef, head.Hash())); err != nil {
+				r.t.Fatal(err)
+			}
+		}
+		if err := wt.Checkout(&git.CheckoutOptions{Branch: branchRef}); err != nil {
+			r.t.Fatal(err)
+		}
+	} else if err := r.work.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branchRef)); err != nil {
+		r.t.Fatal(err)
+	}
+
+	for fileName, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(r.dir, fileName)), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(r.dir, fileName), []byte(content), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+		if _, err := wt.Add(fileName); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+
+	hash, err := wt.Commit(message, &git.CommitOptions{Author: &object.Signature{Name: "gear", Email: "gear@example.com", When: time.Now()}})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+
+	err = r.work.Push(&git.PushOptions{RefSpecs: []config.RefSpec{config.RefSpec(branchRef + ":" + branchRef)}})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+
+	return hash
+}
+
+// tag points the tag to the commit and force pushes it, so it can be moved
+func (r *testRemote) tag(name string, hash plumbing.Hash) {
+	r.t.Helper()
+	tagRef := plumbing.NewTagReferenceName(name)
+	if err := r.work.Storer.SetReference(plumbing.NewHashReference(tagRef, hash)); err != nil {
+		r.t.Fatal(err)
+	}
+
+	err := r.work.Push(&git.PushOptions{RefSpecs: []config.RefSpec{config.RefSpec("+" + tagRef + ":" + tagRef)}})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		r.t.Fatal(err)
+	}
+}
+
+func TestGetGitRemoteHeadUsesConfiguredBranch(t *testing.T) {
+	remote := newTestRemote(t)
+	mainHash := remote.commit("main", "main")
+	remote.commit("develop", "develop")
+	remote.commit("feature", "feature")
+
+	g := NewGitSync(Host{}, SyncState{}, nil, nil, Repository{Url: remote.url, Branch: "main"})
+	ref, hash, err := g.getGitRemoteHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "main" || hash != mainHash.String() {
+		t.Fatalf("expected main at %s, got %s at %s", mainHash, ref, hash)
+	}
+
+	// other branches moving doesn't change the head of the configured branch
+	remote.commit("develop", "develop 2")
+	ref, hash, err = g.getGitRemoteHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "main" || hash != mainHash.String() {
+		t.Fatalf("expected main at %s, got %s at %s", mainHash, ref, hash)
+	}
+
+	newMainHash := remote.commit("main", "main 2")
+	_, hash, err = g.getGitRemoteHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != newMainHash.String() {
+		t.Fatalf("expected main at %s, got %s", newMainHash, hash)
+	}
+}
+
+func TestGetGitRemoteHeadMissingBranch(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.commit("main", "main")
+	remote.commit("develop", "develop")
+
+	g := NewGitSync(Host{}, SyncState{}, nil, nil, Repository{Url: remote.url, Branch: "release"})
+	_, _, err := g.getGitRemoteHead()
+	if !errors.Is(err, ErrRefNotFound) {
+		t.Fatalf("expected ErrRefNotFound, got %v", err)
+	}
+}
+
+func TestGenerateBundleWithCacheExcludesGitFile(t *testing.T) {
+	remote := newTestRemote(t)
+	hash := remote.commit("main", "main")
+
+	for _, cacheDirectory := range []string{"", t.TempDir()} {
+		g := NewGitSync(Host{}, SyncState{}, nil, nil, Repository{Url: remote.url, Branch: "main", CacheDirectory: cacheDirectory})
+		bundle, err := g.GenerateBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bundle.Hash != hash.String() {
+			t.Fatalf("expected bundle of %s, got %s", hash, bundle.Hash)
+		}
+
+		var fileNames []string
+		for _, file := range bundle.Files {
+			fileNames = append(fileNames, file.FileName)
+		}
+
+		if len(fileNames) != 1 || fileNames[0] != "file.txt" {
+			t.Fatalf("expected only file.txt in the bundle with cache directory '%s', got %v", cacheDirectory, fileNames)
+		}
+	}
+}
+
+func TestSyncSkipsRolledBackCommit(t *testing.T) {
+	remote := newTestRemote(t)
+	currentHash := remote.commit("main", "main")
+	rolledBackHash := remote.commit("main", "main 2")
+
+	g := NewGitSync(Host{}, SyncState{CurrentHash: currentHash.String(), RolledBackHash: rolledBackHash.String()}, nil, nil, Repository{Url: remote.url, Branch: "main"})
+	var deployed []string
+	activator := func(bundle *Bundle) error {
+		deployed = append(deployed, bundle.Hash)
+		return nil
+	}
+
+	if err := g.SyncOnce(activator); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployed) != 0 {
+		t.Fatalf("expected the rolled back commit to be skipped, deployed %v", deployed)
+	}
+
+	newHash := remote.commit("main", "main 3")
+	if err := g.SyncOnce(activator); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployed) != 1 || deployed[0] != newHash.String() {
+		t.Fatalf("expected %s to be deployed, deployed %v", newHash, deployed)
+	}
+}
+
+func TestGenerateBundleRefusesTagMovedToOlderCommit(t *testing.T) {
+	remote := newTestRemote(t)
+	oldHash := remote.commit("main", "old")
+	currentHash := remote.commit("main", "current")
+	remote.tag("stable", currentHash)
+
+	for _, cacheDirectory := range []string{"", t.TempDir()} {
+		syncState := SyncState{CurrentHash: currentHash.String(), CurrentRef: "stable"}
+		g := NewGitSync(Host{}, syncState, nil, nil, Repository{Url: remote.url, Tag: "stable", CacheDirectory: cacheDirectory})
+		if _, err := g.GenerateBundle(); err != nil {
+			t.Fatal(err)
+		}
+
+		// a tag moved to an older commit isn't deployed
+		remote.tag("stable", oldHash)
+		if _, err := g.GenerateBundle(); !errors.Is(err, ErrDowngrade) {
+			t.Fatalf("expected ErrDowngrade with cache directory '%s', got %v", cacheDirectory, err)
+		}
+
+		// unless downgrades are allowed
+		allowed := NewGitSync(Host{}, syncState, nil, nil, Repository{Url: remote.url, Tag: "stable", CacheDirectory: cacheDirectory, AllowDowngrade: true})
+		bundle, err := allowed.GenerateBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bundle.Hash != oldHash.String() {
+			t.Fatalf("expected bundle of %s, got %s", oldHash, bundle.Hash)
+		}
+
+		// a tag moved to a newer commit is deployed
+		newHash := remote.commit("main", "new"+cacheDirectory)
+		remote.tag("stable", newHash)
+		bundle, err = g.GenerateBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bundle.Hash != newHash.String() {
+			t.Fatalf("expected bundle of %s, got %s", newHash, bundle.Hash)
+		}
+
+		remote.tag("stable", currentHash)
+	}
+}
+
+func TestGenerateBundleLayersHostOverrideLast(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.commitFiles("main", "overrides", map[string]string{
+		"web/compose.yaml":                     "services: {}",
+		"customise/server1/web/compose.yaml":   "services: {}",
+		"customise/region=eu/web/compose.yaml": "services: {}",
+		"customise/role=web/web/compose.yaml":  "services: {}",
+		"customise/role=db/web/compose.yaml":   "services: {}",
+		"customise/server2/web/compose.yaml":   "services: {}",
+	})
+
+	host := Host{
+		Identifier: "server1",
+		Labels:     map[string]string{"role": "web", "region": "eu"},
+		LabelOrder: []string{"role", "region"},
+	}
+
+	g := NewGitSync(host, SyncState{}, nil, nil, Repository{Url: remote.url, Branch: "main"})
+	bundle, err := g.GenerateBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers := make(map[string]int)
+	for _, file := range bundle.Files {
+		if file.IsCustomisation {
+			layers[file.FileName] = file.Layer
+		}
+	}
+
+	// the label overrides are layered in the order of the labels, not by name, and the host override last
+	role := layers["customise/role=web/web/compose.yaml"]
+	region := layers["customise/region=eu/web/compose.yaml"]
+	identifier := layers["customise/server1/web/compose.yaml"]
+	if len(layers) != 3 || role >= region || region >= identifier {
+		t.Fatalf("expected the role, region and host overrides in that order, got %v", layers)
+	}
+}
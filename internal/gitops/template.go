@@ -0,0 +1,157 @@
+package gitops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// ErrTemplate is returned when a template in the bundle fails to render
+var ErrTemplate = errors.New("bundle contains an invalid template")
+
+const templateExtension = ".tmpl"
+
+// templateData is available to templates in the bundle
+type templateData struct {
+	Hostname   string
+	Identifier string
+	Labels     map[string]string
+	Variables  map[string]string
+	Secrets    map[string]string
+}
+
+// renderTemplates renders all files ending in .tmpl using text/template, the rendered files
+// replace the templates in the bundle without the extension. Secrets are the decrypted files
+// in the bundle, by their file name. Templates that read secrets are rendered as secrets too
+func (g *GitOps) renderTemplates(files []BundleFile) ([]BundleFile, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to get hostname"))
+	}
+
+	data := templateData{
+		Hostname:   hostname,
+		Identifier: g.host.Identifier,
+		Labels:     g.host.Labels,
+		Variables:  g.host.Variables,
+		Secrets:    make(map[string]string),
+	}
+
+	for _, file := range files {
+		if file.IsSecret {
+			data.Secrets[file.FileName] = string(file.Data)
+		}
+	}
+
+	for i, file := range files {
+		if path.Ext(file.FileName) != templateExtension {
+			continue
+		}
+
+		tmpl, err := template.New(file.FileName).Option("missingkey=error").Parse(string(file.Data))
+		if err != nil {
+			return nil, errors.Join(ErrTemplate, err, fmt.Errorf("invalid template '%s'", file.FileName))
+		}
+
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return nil, errors.Join(ErrTemplate, err, fmt.Errorf("failed to render template '%s'", file.FileName))
+		}
+
+		files[i].FileName = strings.TrimSuffix(file.FileName, templateExtension)
+		files[i].Data = rendered.Bytes()
+
+		// a template including secrets is kept out of the deployment directory
+		if readsSecrets(tmpl) {
+			files[i].IsSecret = true
+		}
+	}
+
+	return files, nil
+}
+
+// readsSecrets returns true if the template can read the secrets, either using the Secrets field or the
+// whole template data. Templates it calls are checked too, as they can be given the template data
+func readsSecrets(tmpl *template.Template) bool {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && nodeReadsSecrets(t.Tree.Root, t.Name() == tmpl.Name()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nodeReadsSecrets walks the nodes of a template, root is true while dot is the template data
+func nodeReadsSecrets(node parse.Node, root bool) bool {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return false
+		}
+
+		for _, n := range node.Nodes {
+			if nodeReadsSecrets(n, root) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeReadsSecrets(node.Pipe, root)
+	case *parse.TemplateNode:
+		return nodeReadsSecrets(node.Pipe, root)
+	case *parse.PipeNode:
+		if node == nil {
+			return false
+		}
+
+		for _, cmd := range node.Cmds {
+			if nodeReadsSecrets(cmd, root) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			if nodeReadsSecrets(arg, root) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return branchReadsSecrets(&node.BranchNode, root, root)
+	case *parse.WithNode:
+		return branchReadsSecrets(&node.BranchNode, root && isDot(node.Pipe), root)
+	case *parse.RangeNode:
+		return branchReadsSecrets(&node.BranchNode, root && isDot(node.Pipe), root)
+	case *parse.ChainNode:
+		return slices.Contains(node.Field, "Secrets") || nodeReadsSecrets(node.Node, root)
+	case *parse.FieldNode:
+		return slices.Contains(node.Ident, "Secrets")
+	case *parse.VariableNode:
+		return slices.Equal(node.Ident, []string{"$"}) || slices.Contains(node.Ident, "Secrets")
+	case *parse.DotNode:
+		return root
+	}
+
+	return false
+}
+
+// branchReadsSecrets checks the pipeline of an if, with or range, and its branches. The dot of the first
+// branch depends on the pipeline, the else branch keeps the dot
+func branchReadsSecrets(node *parse.BranchNode, listRoot bool, root bool) bool {
+	return nodeReadsSecrets(node.Pipe, root) || nodeReadsSecrets(node.List, listRoot) || nodeReadsSecrets(node.ElseList, root)
+}
+
+// isDot returns true if the pipeline is only the dot
+func isDot(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+
+	_, ok := pipe.Cmds[0].Args[0].(*parse.DotNode)
+	return ok
+}
@@ -0,0 +1,39 @@
+package gitops
+
+import (
+	"testing"
+)
+
+func TestRenderTemplatesOnlyMarksTemplatesReadingSecrets(t *testing.T) {
+	templates := []struct {
+		fileName string
+		data     string
+		isSecret bool
+	}{
+		{"labels.yaml.tmpl", `role: {{ .Labels.role }}`, false},
+		{"range.yaml.tmpl", `{{ range $key, $value := .Labels }}{{ $key }}: {{ . }}{{ end }}`, false},
+		{"secret.yaml.tmpl", `key: {{ index .Secrets "api-key" }}`, true},
+		{"variable.env.tmpl", `{{ $secrets := .Secrets }}KEY={{ index $secrets "api-key" }}`, true},
+		{"data.yaml.tmpl", `data: {{ printf "%v" . }}`, true},
+		{"root.yaml.tmpl", `{{ range .Labels }}{{ $ }}{{ end }}`, true},
+		{"with.yaml.tmpl", `{{ with . }}{{ .Secrets }}{{ end }}`, true},
+		{"template.yaml.tmpl", `{{ define "secrets" }}{{ . }}{{ end }}{{ template "secrets" .Secrets }}`, true},
+	}
+
+	files := []BundleFile{{FileName: "api-key", Data: []byte("secret"), IsSecret: true}}
+	for _, tmpl := range templates {
+		files = append(files, BundleFile{FileName: tmpl.fileName, Data: []byte(tmpl.data)})
+	}
+
+	g := NewGitSync(Host{Labels: map[string]string{"role": "web"}}, SyncState{}, nil, nil, Repository{})
+	rendered, err := g.renderTemplates(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tmpl := range templates {
+		if file := rendered[i+1]; file.IsSecret != tmpl.isSecret {
+			t.Errorf("expected %s to be secret %v, got %v", file.FileName, tmpl.isSecret, file.IsSecret)
+		}
+	}
+}
@@ -1,20 +1,20 @@
 package logger
 
 import (
-	"os"
+	"io"
 
 	"golang.org/x/exp/slog"
 )
 
-func SetupLogger(level slog.Level, enviroment string) *slog.Logger {
+func SetupLogger(output io.Writer, level slog.Level, enviroment string) *slog.Logger {
 	loggerOpts := slog.HandlerOptions{
 		Level:     level,
 		AddSource: false,
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &loggerOpts))
+	logger := slog.New(slog.NewTextHandler(output, &loggerOpts))
 	if enviroment == "PROD" {
-		logger = slog.New(slog.NewJSONHandler(os.Stdout, &loggerOpts))
+		logger = slog.New(slog.NewJSONHandler(output, &loggerOpts))
 	}
 
 	slog.SetDefault(logger)
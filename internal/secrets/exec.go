@@ -0,0 +1,41 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ExecProvider gets secrets by running a local helper command, the path and key are added as the last
+// two arguments, and the value is read from stdout. A non zero exit code means the secret wasn't found
+type ExecProvider struct {
+	command []string
+}
+
+func NewExecProvider(command []string) *ExecProvider {
+	return &ExecProvider{command: command}
+}
+
+func (p *ExecProvider) GetSecret(ctx context.Context, path string, key string) (string, error) {
+	args := append(append([]string{}, p.command[1:]...), path, key)
+	cmd := exec.CommandContext(ctx, p.command[0], args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "", errors.Join(ErrSecretNotFound, fmt.Errorf("secret helper failed: %s", strings.TrimSpace(stderr.String())))
+	}
+
+	if err != nil {
+		return "", errors.Join(err, errors.New("failed to run secret helper"))
+	}
+
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
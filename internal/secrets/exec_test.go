@@ -0,0 +1,37 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestExecProvider(t *testing.T) {
+	provider := NewExecProvider([]string{"sh", "-c", `test "$1" = app/db && test "$2" = password && echo hunter2`, "helper"})
+
+	value, err := provider.GetSecret(context.Background(), "app/db", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "hunter2" {
+		t.Fatalf("expected 'hunter2', got '%s'", value)
+	}
+}
+
+func TestExecProviderSecretNotFound(t *testing.T) {
+	provider := NewExecProvider([]string{"sh", "-c", `echo "no secret $1" >&2; exit 1`, "helper"})
+
+	_, err := provider.GetSecret(context.Background(), "app/db", "password")
+	if !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("expected ErrSecretNotFound, got %v", err)
+	}
+}
+
+func TestExecProviderMissingCommand(t *testing.T) {
+	provider := NewExecProvider([]string{"gear-missing-secret-helper"})
+
+	_, err := provider.GetSecret(context.Background(), "app/db", "password")
+	if err == nil || errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("expected an error other than ErrSecretNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrSecretNotFound is returned when the secret or the key in it doesn't exist
+var ErrSecretNotFound = errors.New("secret not found")
+
+// Provider resolves secrets stored outside the repository, the path identifies
+// the secret in the provider, and the key is the value in the secret to return
+type Provider interface {
+	GetSecret(ctx context.Context, path string, key string) (string, error)
+}
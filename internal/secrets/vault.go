@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// VaultProvider gets secrets from a HashiCorp Vault KV secrets engine, both version 1 and 2 are supported
+type VaultProvider struct {
+	address   string
+	token     string
+	mount     string
+	kvVersion int
+	client    *http.Client
+}
+
+func NewVaultProvider(address string, token string, mount string, kvVersion int) *VaultProvider {
+	return &VaultProvider{
+		address:   strings.TrimSuffix(address, "/"),
+		token:     token,
+		mount:     strings.Trim(mount, "/"),
+		kvVersion: kvVersion,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *VaultProvider) GetSecret(ctx context.Context, path string, key string) (string, error) {
+	// version 2 keeps the secrets below data/, and wraps them in an extra data object
+	secretUrl := fmt.Sprintf("%s/v1/%s/%s", p.address, p.mount, escapePath(path))
+	if p.kvVersion == 2 {
+		secretUrl = fmt.Sprintf("%s/v1/%s/data/%s", p.address, p.mount, escapePath(path))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, secretUrl, nil)
+	if err != nil {
+		return "", errors.Join(err, errors.New("failed to create vault request"))
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errors.Join(err, errors.New("failed to get secret from vault"))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errors.Join(ErrSecretNotFound, fmt.Errorf("secret '%s' not found in vault", path))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get secret '%s' from vault, status %d", path, resp.StatusCode)
+	}
+
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Join(err, errors.New("invalid vault response"))
+	}
+
+	data := body.Data
+	if p.kvVersion == 2 {
+		var wrapped struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(body.Data, &wrapped); err != nil {
+			return "", errors.Join(err, errors.New("invalid vault response"))
+		}
+		data = wrapped.Data
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return "", errors.Join(err, errors.New("invalid vault response"))
+	}
+
+	value, ok := values[key]
+	if !ok {
+		return "", errors.Join(ErrSecretNotFound, fmt.Errorf("key '%s' not found in vault secret '%s'", key, path))
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	// other values are returned as json, like they are stored
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", errors.Join(err, errors.New("invalid vault secret value"))
+	}
+
+	return string(encoded), nil
+}
+
+func escapePath(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestVault returns a vault server with a single secret, at the path of the kv version
+func newTestVault(t *testing.T, secretPath string, body string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.URL.EscapedPath() != secretPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestVaultProviderKVVersion1(t *testing.T) {
+	server := newTestVault(t, "/v1/secret/app/db", `{"data": {"password": "hunter2", "port": 5432}}`)
+	provider := NewVaultProvider(server.URL+"/", "token", "/secret/", 1)
+
+	value, err := provider.GetSecret(context.Background(), "app/db", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "hunter2" {
+		t.Fatalf("expected 'hunter2', got '%s'", value)
+	}
+
+	// values that are not strings are returned as json
+	value, err = provider.GetSecret(context.Background(), "app/db", "port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "5432" {
+		t.Fatalf("expected '5432', got '%s'", value)
+	}
+}
+
+func TestVaultProviderKVVersion2(t *testing.T) {
+	server := newTestVault(t, "/v1/secret/data/app/db", `{"data": {"data": {"password": "hunter2"}, "metadata": {"version": 3}}}`)
+	provider := NewVaultProvider(server.URL, "token", "secret", 2)
+
+	value, err := provider.GetSecret(context.Background(), "app/db", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "hunter2" {
+		t.Fatalf("expected 'hunter2', got '%s'", value)
+	}
+}
+
+func TestVaultProviderSecretNotFound(t *testing.T) {
+	server := newTestVault(t, "/v1/secret/data/app/db", `{"data": {"data": {"password": "hunter2"}}}`)
+	provider := NewVaultProvider(server.URL, "token", "secret", 2)
+
+	_, err := provider.GetSecret(context.Background(), "app/missing", "password")
+	if !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("expected ErrSecretNotFound, got %v", err)
+	}
+}
+
+func TestVaultProviderKeyNotFound(t *testing.T) {
+	server := newTestVault(t, "/v1/secret/data/app/db", `{"data": {"data": {"password": "hunter2"}}}`)
+	provider := NewVaultProvider(server.URL, "token", "secret", 2)
+
+	_, err := provider.GetSecret(context.Background(), "app/db", "username")
+	if !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("expected ErrSecretNotFound, got %v", err)
+	}
+}
+
+func TestVaultProviderError(t *testing.T) {
+	server := newTestVault(t, "/v1/secret/data/app/db", `{}`)
+	provider := NewVaultProvider(server.URL, "wrong", "secret", 2)
+
+	_, err := provider.GetSecret(context.Background(), "app/db", "password")
+	if err == nil || errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("expected an error other than ErrSecretNotFound, got %v", err)
+	}
+}
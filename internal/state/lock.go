@@ -0,0 +1,36 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Lock takes an exclusive lock of the state file, so only one gear process deploys a repository at a time.
+// It waits until the lock is released by the other process, and returns the function releasing it
+func Lock(fileName string) (func(), error) {
+	file, err := os.OpenFile(fileName+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to open state lock"))
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, errors.Join(err, errors.New("failed to lock state"))
+	}
+
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// ModTime returns when the state file was last written, it's zero if the file doesn't exist
+func ModTime(fileName string) time.Time {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -2,20 +2,64 @@ package state
 
 import (
 	"os"
+	"slices"
+	"time"
 
 	"golang.org/x/exp/slog"
 	"gopkg.in/yaml.v3"
 )
 
+type DeployedProject struct {
+	Files    []string `yaml:"files"`
+	EnvFiles []string `yaml:"envFiles,omitempty"`
+	Digest   string   `yaml:"digest"`
+	// Hash is the commit the project was last started from, its containers use the files of that deployment
+	Hash string `yaml:"hash,omitempty"`
+	// MountsSecrets is set if the containers mount files from the secrets directory of the commit
+	MountsSecrets bool `yaml:"mountsSecrets,omitempty"`
+}
+
+// DeploymentRecord is a single deployment attempt, kept in the history of the state
+type DeploymentRecord struct {
+	Hash   string    `yaml:"hash"`
+	Ref    string    `yaml:"ref,omitempty"`
+	Status string    `yaml:"status"`
+	Time   time.Time `yaml:"time"`
+}
+
 type DeploymentState struct {
-	CurrentHash      string   `yaml:"currentHash"`
-	DeployedServices []string `yaml:"deployedServices"`
+	CurrentHash      string                     `yaml:"currentHash"`
+	CurrentRef       string                     `yaml:"currentRef,omitempty"`
+	CurrentTree      string                     `yaml:"currentTree,omitempty"`
+	FailedHash       string                     `yaml:"failedHash,omitempty"`
+	RolledBackHash   string                     `yaml:"rolledBackHash,omitempty"`
+	DeployedServices []string                   `yaml:"deployedServices"`
+	Projects         map[string]DeployedProject `yaml:"projects"`
+	History          []DeploymentRecord         `yaml:"history,omitempty"`
 }
 
+const (
+	StatusDeployed   = "deployed"
+	StatusFailed     = "failed"
+	StatusRolledBack = "rolled back"
+)
+
 const deploymentStateFileName = ".deployment-state.yaml"
 
-func LoadDeploymentState() *DeploymentState {
-	data, err := os.ReadFile(deploymentStateFileName)
+// maxHistory is the number of deployments kept in the history
+const maxHistory = 50
+
+// FileName returns the name of the state file for a repository, each named repository has its own state
+func FileName(repositoryName string) string {
+	if repositoryName == "" {
+		return deploymentStateFileName
+	}
+
+	return ".deployment-state-" + repositoryName + ".yaml"
+}
+
+func LoadDeploymentState(fileName string) *DeploymentState {
+	data, err := os.ReadFile(fileName)
 	if err != nil {
 		return &DeploymentState{}
 	}
@@ -23,28 +67,76 @@ func LoadDeploymentState() *DeploymentState {
 	var state DeploymentState
 	err = yaml.Unmarshal([]byte(data), &state)
 	if err != nil {
-		slog.Warn("invalid deployment state found, starting new")
+		slog.Warn("invalid deployment state found, starting new", slog.String("file", fileName))
 		return &DeploymentState{}
 	}
 
 	return &state
 }
 
-func SaveDeploymentState(currentHash string, deployedServices []string) (*DeploymentState, error) {
+// SaveDeploymentState records a successful deployment, the history is kept from the current state
+func SaveDeploymentState(fileName string, current *DeploymentState, currentHash string, currentRef string, currentTree string, deployedServices []string, projects map[string]DeployedProject) (*DeploymentState, error) {
 	state := DeploymentState{
 		CurrentHash:      currentHash,
+		CurrentRef:       currentRef,
+		CurrentTree:      currentTree,
 		DeployedServices: deployedServices,
+		Projects:         projects,
+		History:          addHistory(current.History, currentHash, currentRef, StatusDeployed),
 	}
 
-	data, err := yaml.Marshal(state)
-	if err != nil {
-		return nil, err
+	return &state, writeDeploymentState(fileName, &state)
+}
+
+// SaveFailedDeployment records a commit that failed to deploy, while keeping the currently deployed commit
+func SaveFailedDeployment(fileName string, current *DeploymentState, failedHash string, failedRef string) (*DeploymentState, error) {
+	state := *current
+	state.FailedHash = failedHash
+	state.History = addHistory(current.History, failedHash, failedRef, StatusFailed)
+
+	return &state, writeDeploymentState(fileName, &state)
+}
+
+// SaveRollback records a commit that was rolled back, so it's not deployed again until a newer commit is pushed
+func SaveRollback(fileName string, current *DeploymentState, rolledBackHash string, rolledBackRef string) (*DeploymentState, error) {
+	state := *current
+	state.RolledBackHash = rolledBackHash
+	state.History = addHistory(current.History, rolledBackHash, rolledBackRef, StatusRolledBack)
+
+	return &state, writeDeploymentState(fileName, &state)
+}
+
+// addHistory appends a deployment to the history, dropping the oldest deployments
+func addHistory(history []DeploymentRecord, hash string, ref string, status string) []DeploymentRecord {
+	history = append(slices.Clone(history), DeploymentRecord{
+		Hash:   hash,
+		Ref:    ref,
+		Status: status,
+		Time:   time.Now().UTC(),
+	})
+
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
 	}
 
-	err = os.WriteFile(deploymentStateFileName, data, os.ModePerm)
+	return history
+}
+
+// ProjectFiles returns the compose files a project was deployed with
+func (s *DeploymentState) ProjectFiles(projectName string) []string {
+	if project, ok := s.Projects[projectName]; ok && len(project.Files) > 0 {
+		return project.Files
+	}
+
+	// state from older versions only know the project name
+	return []string{projectName + ".yaml"}
+}
+
+func writeDeploymentState(fileName string, state *DeploymentState) error {
+	data, err := yaml.Marshal(state)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &state, nil
+	return os.WriteFile(fileName, data, os.ModePerm)
 }
@@ -0,0 +1,69 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockWaitsForRelease(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), FileName("test"))
+	unlock, err := Lock(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := Lock(fileName)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected the second lock to wait for the first one to be released")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second lock to be taken when the first one was released")
+	}
+}
+
+func TestSaveRollbackIsNotAFailure(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), FileName("test"))
+	current, err := SaveDeploymentState(fileName, &DeploymentState{}, "old", "main", "tree", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SaveRollback(fileName, current, "new", "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	state := LoadDeploymentState(fileName)
+	if state.CurrentHash != "old" || state.RolledBackHash != "new" || state.FailedHash != "" {
+		t.Fatalf("expected old deployed with new rolled back, got %+v", state)
+	}
+
+	if record := state.History[len(state.History)-1]; record.Hash != "new" || record.Status != StatusRolledBack {
+		t.Fatalf("expected the rollback in the history, got %+v", record)
+	}
+
+	// the rolled back commit is cleared when a newer commit is deployed
+	state, err = SaveDeploymentState(fileName, state, "newer", "main", "tree", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.RolledBackHash != "" {
+		t.Fatalf("expected the rolled back commit to be cleared, got %s", state.RolledBackHash)
+	}
+}
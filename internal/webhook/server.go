@@ -0,0 +1,138 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// maxPayloadSize is the largest webhook payload accepted, github sends up to 25MB
+const maxPayloadSize = 25 << 20
+
+// PushEvent is a received push, the repositories are the urls of the pushed repository in the payload
+type PushEvent struct {
+	Provider     string
+	Ref          string
+	After        string
+	Repositories []string
+}
+
+type Server struct {
+	server *http.Server
+	secret []byte
+	onPush func(PushEvent)
+}
+
+func NewServer(listen string, path string, secret []byte, onPush func(PushEvent)) *Server {
+	s := &Server{
+		secret: secret,
+		onPush: onPush,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, s.handleWebhook)
+	s.server = &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	return s
+}
+
+// Start runs the webhook listener in the background, until the context is cancelled
+func (s *Server) Start(ctx context.Context) {
+	go func() {
+		slog.Info("starting webhook listener", slog.String("address", s.server.Addr))
+		err := s.server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("webhook listener stopped", slog.String("error", err.Error()))
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		s.server.Shutdown(shutdownCtx)
+	}()
+}
+
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	provider := detectProvider(r.Header)
+	if err := verifyRequest(provider, r.Header, body, s.secret); err != nil {
+		slog.Warn("rejected webhook", slog.String("provider", provider), slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !isPushEvent(provider, r.Header) {
+		slog.Debug("ignoring webhook event", slog.String("provider", provider))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// all supported providers use the same field names for the ref, but not for the repository urls
+	var payload struct {
+		Ref        string `json:"ref"`
+		After      string `json:"after"`
+		Repository struct {
+			CloneURL   string `json:"clone_url"`
+			SSHURL     string `json:"ssh_url"`
+			HTMLURL    string `json:"html_url"`
+			GitHTTPURL string `json:"git_http_url"`
+			GitSSHURL  string `json:"git_ssh_url"`
+		} `json:"repository"`
+		Project struct {
+			GitHTTPURL string `json:"git_http_url"`
+			GitSSHURL  string `json:"git_ssh_url"`
+			WebURL     string `json:"web_url"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil && provider != providerGeneric {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var repositories []string
+	for _, url := range []string{
+		payload.Repository.CloneURL,
+		payload.Repository.SSHURL,
+		payload.Repository.HTMLURL,
+		payload.Repository.GitHTTPURL,
+		payload.Repository.GitSSHURL,
+		payload.Project.GitHTTPURL,
+		payload.Project.GitSSHURL,
+		payload.Project.WebURL,
+	} {
+		if url != "" {
+			repositories = append(repositories, url)
+		}
+	}
+
+	slog.Info("received push webhook", slog.String("provider", provider), slog.String("ref", payload.Ref), slog.String("after", payload.After))
+	s.onPush(PushEvent{
+		Provider:     provider,
+		Ref:          payload.Ref,
+		After:        payload.After,
+		Repositories: repositories,
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,92 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	providerGitHub  = "github"
+	providerGitLab  = "gitlab"
+	providerGitea   = "gitea"
+	providerGeneric = "generic"
+)
+
+// genericSignatureHeader is used by the generic format, with the value "sha256=<hex hmac of body>"
+const genericSignatureHeader = "X-Gear-Signature"
+
+func detectProvider(header http.Header) string {
+	// gitea also sends the github headers, so it needs to be checked first
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		return providerGitea
+	case header.Get("X-GitHub-Event") != "":
+		return providerGitHub
+	case header.Get("X-Gitlab-Event") != "":
+		return providerGitLab
+	default:
+		return providerGeneric
+	}
+}
+
+func isPushEvent(provider string, header http.Header) bool {
+	switch provider {
+	case providerGitea:
+		return header.Get("X-Gitea-Event") == "push"
+	case providerGitHub:
+		return header.Get("X-GitHub-Event") == "push"
+	case providerGitLab:
+		return header.Get("X-Gitlab-Event") == "Push Hook" || header.Get("X-Gitlab-Event") == "Tag Push Hook"
+	default:
+		return true
+	}
+}
+
+func verifyRequest(provider string, header http.Header, body []byte, secret []byte) error {
+	switch provider {
+	case providerGitea:
+		return verifyHMAC(header.Get("X-Gitea-Signature"), body, secret)
+	case providerGitHub:
+		signature, ok := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			return errors.New("missing signature")
+		}
+		return verifyHMAC(signature, body, secret)
+	case providerGitLab:
+		// gitlab does not sign the payload, but sends the secret token as is
+		if subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), secret) != 1 {
+			return errors.New("invalid token")
+		}
+		return nil
+	default:
+		signature, ok := strings.CutPrefix(header.Get(genericSignatureHeader), "sha256=")
+		if !ok {
+			return errors.New("missing signature")
+		}
+		return verifyHMAC(signature, body, secret)
+	}
+}
+
+func verifyHMAC(signature string, body []byte, secret []byte) error {
+	if signature == "" {
+		return errors.New("missing signature")
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
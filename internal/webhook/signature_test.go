@@ -0,0 +1,64 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func sign(body []byte, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	signature := sign(body, secret)
+	otherSignature := sign(body, []byte("other"))
+
+	tests := []struct {
+		name     string
+		provider string
+		header   http.Header
+		valid    bool
+	}{
+		{"github valid signature", providerGitHub, http.Header{"X-Hub-Signature-256": {"sha256=" + signature}}, true},
+		{"github bad signature", providerGitHub, http.Header{"X-Hub-Signature-256": {"sha256=" + otherSignature}}, false},
+		{"github missing header", providerGitHub, http.Header{}, false},
+		{"github wrong prefix", providerGitHub, http.Header{"X-Hub-Signature-256": {"sha1=" + signature}}, false},
+		{"gitea valid signature", providerGitea, http.Header{"X-Gitea-Signature": {signature}}, true},
+		{"gitea bad signature", providerGitea, http.Header{"X-Gitea-Signature": {otherSignature}}, false},
+		{"gitea missing header", providerGitea, http.Header{}, false},
+		{"gitea wrong prefix", providerGitea, http.Header{"X-Gitea-Signature": {"sha256=" + signature}}, false},
+		{"gitlab valid token", providerGitLab, http.Header{"X-Gitlab-Token": {"secret"}}, true},
+		{"gitlab bad token", providerGitLab, http.Header{"X-Gitlab-Token": {"other"}}, false},
+		{"gitlab missing header", providerGitLab, http.Header{}, false},
+		{"generic valid signature", providerGeneric, http.Header{"X-Gear-Signature": {"sha256=" + signature}}, true},
+		{"generic bad signature", providerGeneric, http.Header{"X-Gear-Signature": {"sha256=" + otherSignature}}, false},
+		{"generic missing header", providerGeneric, http.Header{}, false},
+		{"generic wrong prefix", providerGeneric, http.Header{"X-Gear-Signature": {"sha1=" + signature}}, false},
+		{"generic without prefix", providerGeneric, http.Header{"X-Gear-Signature": {signature}}, false},
+	}
+
+	for _, test := range tests {
+		err := verifyRequest(test.provider, test.header, body, secret)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected the request to be verified, got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected the request to be rejected", test.name)
+		}
+	}
+}
+
+func TestVerifyRequestModifiedBody(t *testing.T) {
+	secret := []byte("secret")
+	header := http.Header{"X-Gear-Signature": {"sha256=" + sign([]byte(`{"ref":"refs/heads/main"}`), secret)}}
+	if err := verifyRequest(providerGeneric, header, []byte(`{"ref":"refs/heads/other"}`), secret); err == nil {
+		t.Fatal("expected a modified body to be rejected")
+	}
+}